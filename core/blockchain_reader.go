@@ -303,6 +303,12 @@ func (bc *BlockChain) GetTd(hash common.Hash, number uint64) *big.Int {
 	return bc.hc.GetTd(hash, number)
 }
 
+// PruningHorizon returns the number of the first block whose total difficulty
+// is still retained in the database.
+func (bc *BlockChain) PruningHorizon() uint64 {
+	return bc.hc.PruningHorizon()
+}
+
 // HasState checks if state trie is fully present in the database or not.
 func (bc *BlockChain) HasState(hash common.Hash) bool {
 	_, err := bc.stateCache.OpenTrie(hash)
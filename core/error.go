@@ -32,6 +32,34 @@ var (
 	// ErrNoGenesis is returned when there is no Genesis Block.
 	ErrNoGenesis = errors.New("genesis not found in chain")
 
+	// ErrMissingTD is returned by the fork chooser if the total difficulty of
+	// either the local or the external header is not available.
+	ErrMissingTD = errors.New("missing total difficulty")
+
+	// ErrNilHeader is returned by the fork chooser if either the local or the
+	// external header is nil.
+	ErrNilHeader = errors.New("nil header")
+
+	// ErrIncompleteHeader is returned by the fork chooser if a header lacks a
+	// field required to evaluate it.
+	ErrIncompleteHeader = errors.New("incomplete header")
+
+	// ErrCorruptTD is returned by the fork chooser if the total difficulty of
+	// a block is one it can't legitimately have, hinting at database corruption.
+	ErrCorruptTD = errors.New("corrupt total difficulty")
+
+	// ErrNonCanonicalCurrent is returned by the fork chooser if it's asked to
+	// evaluate against a local header which is not on the canonical chain.
+	ErrNonCanonicalCurrent = errors.New("local header not canonical")
+
+	// ErrHashCollision is returned by the fork chooser if the local and the
+	// external header share a hash but not a block number.
+	ErrHashCollision = errors.New("header hash collision")
+
+	// ErrUnexpectedTie is returned by the fork chooser in strict tie mode if two
+	// headers can only be told apart by the tie breaker.
+	ErrUnexpectedTie = errors.New("unexpected fork choice tie")
+
 	errSideChainReceipts = errors.New("side blocks can't be accepted as ancient chain data")
 )
 
@@ -17,27 +17,196 @@
 package core
 
 import (
+	"bytes"
+	"context"
 	crand "crypto/rand"
-	"errors"
+	"encoding/binary"
+	"fmt"
 	"math/big"
 	mrand "math/rand"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/lru"
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params"
 )
 
+var (
+	forkChoiceTdGapHist = metrics.NewRegisteredHistogram("chain/forkchoice/tdgap", nil, metrics.NewExpDecaySample(1028, 0.015))
+	forkChoiceTdTimer   = metrics.NewRegisteredTimer("chain/forkchoice/td/evaluations", nil)
+
+	forkChoiceLocalTdGauge  = metrics.NewRegisteredGauge("chain/forkchoice/td/local", nil)
+	forkChoiceExternTdGauge = metrics.NewRegisteredGauge("chain/forkchoice/td/extern", nil)
+
+	forkChoiceFlipReorgCounter = metrics.NewRegisteredCounter("chain/forkchoice/coinflip/reorg", nil)
+	forkChoiceFlipKeepCounter  = metrics.NewRegisteredCounter("chain/forkchoice/coinflip/keep", nil)
+
+	forkChoiceShadowDisagreeCounter = metrics.NewRegisteredCounter("chain/forkchoice/shadow/disagreements", nil)
+)
+
+const (
+	// defaultTdCacheSize is the number of total difficulties memoized by the
+	// fork chooser unless configured otherwise.
+	defaultTdCacheSize = 256
+
+	// maxAncestorLookups is the maximum number of headers retrieved to find the
+	// common ancestor of an accepted reorg for logging.
+	maxAncestorLookups = 1024
+
+	// defaultReorgTieProbability is the probability of reorging onto an extern
+	// header with the same total difficulty and height as the local head.
+	defaultReorgTieProbability = 0.5
+)
+
 // ChainReader defines a small collection of methods needed to access the local
 // blockchain during header verification. It's implemented by both blockchain
 // and lightchain.
+//
+// The fork chooser only ever reads headers and total difficulties through it,
+// never block bodies, so it works on header-only data during header-first sync.
 type ChainReader interface {
 	// Config retrieves the header chain's chain configuration.
 	Config() *params.ChainConfig
 
 	// GetTd returns the total difficulty of a local block.
 	GetTd(common.Hash, uint64) *big.Int
+
+	// GetCanonicalHash returns the hash of the canonical block at a height.
+	GetCanonicalHash(number uint64) common.Hash
+
+	// GetHeaderByHash retrieves a block header from the database by its hash.
+	GetHeaderByHash(hash common.Hash) *types.Header
+
+	// CurrentHeader retrieves the current head header of the canonical chain.
+	CurrentHeader() *types.Header
+
+	// PruningHorizon returns the number of the first block whose total
+	// difficulty is still retained locally.
+	PruningHorizon() uint64
+}
+
+// Fork choice rules reported in a ReorgResult.
+const (
+	RuleSameHeader      = iota + 1 // The extern header is the local head
+	RulePruned                     // The extern total difficulty was pruned
+	RuleTrusted                    // The extern header is trusted despite its unknown total difficulty
+	RuleTerminalTD                 // The extern header reached the terminal total difficulty
+	RuleTotalDifficulty            // The total difficulties differ
+	RuleStickyHead                 // The heavier extern header is too close to the local head
+	RuleEqualTD                    // The total difficulties are (treated as) equal and selfish mining protection is disabled
+	RuleBlockNumber                // The total difficulties are equal, the lower header wins
+	RulePreserve                   // The total difficulties and heights are equal, a preserved header wins
+	RuleTieBreak                   // The total difficulties and heights are equal, the tie breaker decided
+	RuleMinTDAdvantage             // The heavier extern header is below the local head, but not heavier by enough
+)
+
+// ReorgResult is the outcome of a fork choice evaluation.
+type ReorgResult struct {
+	Reorg    bool     // Whether the extern header should become the head
+	Rule     int      // Rule which decided the outcome, zero on error
+	LocalTD  *big.Int // Total difficulty of the local head
+	ExternTD *big.Int // Total difficulty of the extern header, nil if unknown
+}
+
+// decided returns a copy of the result with the outcome filled in.
+func (r ReorgResult) decided(reorg bool, rule int) ReorgResult {
+	r.Reorg, r.Rule = reorg, rule
+	return r
+}
+
+// detached returns a copy of the result whose total difficulties don't share
+// memory with the memoized ones, so that callers can freely modify them.
+func (r ReorgResult) detached() ReorgResult {
+	if r.LocalTD != nil {
+		r.LocalTD = new(big.Int).Set(r.LocalTD)
+	}
+	if r.ExternTD != nil {
+		r.ExternTD = new(big.Int).Set(r.ExternTD)
+	}
+	return r
+}
+
+// ForkChoicer decides whether an external header should replace the local
+// canonical head.
+type ForkChoicer interface {
+	// ReorgNeeded returns whether the reorg should be applied based on the
+	// given external header and local canonical chain.
+	ReorgNeeded(current *types.Header, extern *types.Header) (bool, error)
+}
+
+var (
+	_ ForkChoicer = (*ForkChoice)(nil)
+	_ ForkChoicer = (*shadowForkChoice)(nil)
+)
+
+// shadowForkChoice is a fork chooser following a primary one, while checking
+// its decisions against a shadow one.
+type shadowForkChoice struct {
+	primary ForkChoicer
+	shadow  ForkChoicer
+}
+
+// NewForkChoiceShadow creates a fork chooser which decides with primary, but
+// also consults shadow and logs and counts whenever the two disagree. It helps
+// validating a migration between fork choice policies before switching over.
+//
+// A *ForkChoice shadow is evaluated quietly: it doesn't update the fork choice
+// metrics nor log reorgs, so those only reflect the primary's decisions. Other
+// shadows are called through ReorgNeeded with all their side effects.
+//
+// BlockChain always decides with its own *ForkChoice, so the shadow can only be
+// plugged into code accepting a ForkChoicer, e.g. HeaderChain.InsertHeaderChain.
+func NewForkChoiceShadow(primary, shadow ForkChoicer) ForkChoicer {
+	return &shadowForkChoice{primary: primary, shadow: shadow}
+}
+
+// quietForkChoicer is implemented by fork choosers able to evaluate headers
+// without updating metrics or logging.
+type quietForkChoicer interface {
+	evaluateQuiet(current *types.Header, extern *types.Header) (ReorgResult, error)
+}
+
+// ReorgNeeded implements ForkChoicer, returning the primary's decision. The
+// shadow is not consulted if the primary failed or if the extern header is the
+// local head itself.
+func (f *shadowForkChoice) ReorgNeeded(current *types.Header, extern *types.Header) (bool, error) {
+	var (
+		res ReorgResult
+		err error
+	)
+	if primary, ok := f.primary.(*ForkChoice); ok {
+		res, err = primary.Evaluate(current, extern)
+	} else {
+		res.Reorg, err = f.primary.ReorgNeeded(current, extern)
+	}
+	if err != nil || res.Rule == RuleSameHeader {
+		return res.Reorg, err
+	}
+	reorg := res.Reorg
+
+	var (
+		shadow bool
+		serr   error
+	)
+	if quiet, ok := f.shadow.(quietForkChoicer); ok {
+		res, serr = quiet.evaluateQuiet(current, extern)
+		shadow = res.Reorg
+	} else {
+		shadow, serr = f.shadow.ReorgNeeded(current, extern)
+	}
+	if serr != nil {
+		log.Debug("Shadow fork choice failed", "number", extern.Number, "hash", extern.Hash(), "err", serr)
+		return reorg, nil
+	}
+	if shadow != reorg {
+		forkChoiceShadowDisagreeCounter.Inc(1)
+		log.Warn("Fork choice disagreement", "number", extern.Number, "hash", extern.Hash(), "primary", reorg, "shadow", shadow)
+	}
+	return reorg, nil
 }
 
 // ForkChoice is the fork chooser based on the highest total difficulty of the
@@ -46,27 +215,326 @@ type ChainReader interface {
 // offering fork choice during the eth1/2 merge phase, but also keep the compatibility
 // for all other proof-of-work networks.
 type ForkChoice struct {
-	chain ChainReader
-	rand  *mrand.Rand
+	chain  ChainReader
+	config *params.ChainConfig // Chain configuration, immutable after genesis
+
+	seedSource randSource // Source of the seed of rand, used at construction
+	rand       *mrand.Rand
 
 	// preserve is a helper function used in td fork choice.
 	// Miners will prefer to choose the local mined block if the
 	// local td is equal to the extern one. It can be nil for light
 	// client
 	preserve func(header *types.Header) bool
+
+	// coinFlip decides whether to reorg onto an extern header with the same
+	// total difficulty and height as the local head, if neither of them is
+	// preserved. It defaults to a random flip, biased by reorgTieProbability.
+	coinFlip            func() bool
+	countFlips          bool // Whether coinFlip is the default, audited one
+	reorgTieProbability float64
+
+	// deterministicTies replaces the coin flip with the lowest hash rule of
+	// EIP-3436, so that all nodes settle on the same head on PoA chains.
+	deterministicTies bool
+
+	// strictTies makes the fork chooser fail on ties it could only resolve with
+	// the tie breaker, instead of breaking them.
+	strictTies bool
+
+	// stickyDepth and minTDAdvantage make the local head resist shallow reorgs.
+	// A reorg onto an extern header less than stickyDepth blocks below the
+	// local head, or at its height, is declined unless its total difficulty
+	// surpasses the local one by at least minTDAdvantage.
+	stickyDepth    uint64
+	minTDAdvantage *big.Int
+
+	// minReorgTDAdvantage is the margin by which the total difficulty of an
+	// extern header not above the local head must exceed the local one to win
+	// outright. Smaller gains are treated as ties. Nil accepts any positive
+	// advantage.
+	minReorgTDAdvantage *big.Int
+
+	// checkCanonical makes the fork chooser verify that the local header it is
+	// handed is actually on the canonical chain, at the cost of a lookup.
+	checkCanonical bool
+
+	// parentTdFallback derives the total difficulty of an extern header from
+	// its parent if the header's own is not yet stored.
+	parentTdFallback bool
+
+	// trustExternOnMissingTD identifies extern headers from a trusted source,
+	// e.g. the consensus client during sync, which are accepted as the new
+	// head even if their total difficulty is not known locally.
+	trustExternOnMissingTD func(header *types.Header) bool
+
+	// disableSelfishMiningProtection keeps the local head on every exact total
+	// difficulty tie, skipping the height and coin flip based tie breaking.
+	disableSelfishMiningProtection bool
+
+	tdCacheSize int                              // Maximum number of memoized total difficulties
+	tdCache     *lru.Cache[tdCacheKey, *big.Int] // Recently looked up total difficulties, nil if disabled
 }
 
-func NewForkChoice(chainReader ChainReader, preserve func(header *types.Header) bool) *ForkChoice {
-	// Seed a fast but crypto originating random generator
-	seed, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
+// tdCacheKey identifies a block whose total difficulty is memoized.
+type tdCacheKey struct {
+	hash   common.Hash
+	number uint64
+}
+
+// ForkChoiceOption is a configuration option for the fork chooser.
+type ForkChoiceOption func(*ForkChoice)
+
+// WithTdCacheSize sets the number of total difficulties memoized across
+// ReorgNeeded evaluations. A size of zero disables the cache.
+func WithTdCacheSize(size int) ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.tdCacheSize = size
+	}
+}
+
+// WithCoinFlip overrides the random coin flip used to break ties between
+// headers with equal total difficulty and height, e.g. to make the fork choice
+// deterministic.
+func WithCoinFlip(coinFlip func() bool) ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.coinFlip = coinFlip
+	}
+}
+
+// WithReorgTieProbability sets the probability of the default coin flip
+// reorging onto an extern header with the same total difficulty and height as
+// the local head. Values below 0.5 bias towards keeping the local chain. The
+// probability must be within [0, 1].
+func WithReorgTieProbability(p float64) ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.reorgTieProbability = p
+	}
+}
+
+// WithStickyHead declines reorgs onto extern headers which are at the height of
+// the local head or less than depth blocks below it, unless their total
+// difficulty exceeds the local one by at least minTDAdvantage. Headers above
+// the local head are never held back. A zero depth or advantage disables it.
+func WithStickyHead(depth uint64, minTDAdvantage *big.Int) ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.stickyDepth = depth
+		f.minTDAdvantage = minTDAdvantage
+	}
+}
+
+// WithMinReorgTDAdvantage requires the total difficulty of an extern header at
+// or below the height of the local head to exceed the local one by at least
+// delta to trigger a reorg. Lower headers with a smaller advantage are declined,
+// ones at the same height are handled like ties. Heavier headers above the
+// local head, e.g. its children, always win, so the head keeps advancing block
+// by block. A nil or non-positive delta disables the threshold.
+func WithMinReorgTDAdvantage(delta *big.Int) ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.minReorgTDAdvantage = delta
+	}
+}
+
+// WithDeterministicTies breaks ties between headers with equal total difficulty
+// and height by preferring the lower block hash, as in rule 4 of EIP-3436,
+// instead of flipping a coin. Repeated evaluations of the same pair of headers
+// always yield the same decision, avoiding oscillation between two valid
+// blocks on proof-of-authority chains.
+func WithDeterministicTies() ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.deterministicTies = true
+	}
+}
+
+// WithStrictTies makes ReorgNeeded fail with ErrUnexpectedTie instead of
+// consulting the tie breaker if neither total difficulty, height nor preserve
+// tell the local and extern headers apart. It's meant for networks where such
+// ties hint at a consensus problem that should be surfaced.
+func WithStrictTies() ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.strictTies = true
+	}
+}
+
+// WithCanonicalCheck makes ReorgNeeded reject local headers which are not part
+// of the canonical chain with ErrNonCanonicalCurrent.
+func WithCanonicalCheck() ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.checkCanonical = true
+	}
+}
+
+// WithParentTdFallback makes the fork chooser compute the total difficulty of
+// an extern header from its parent's total difficulty and its own difficulty,
+// if the former is not available yet. It is disabled by default not to mask
+// genuine gaps in the database.
+func WithParentTdFallback() ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.parentTdFallback = true
+	}
+}
+
+// WithTrustExternOnMissingTD makes ReorgNeeded accept extern headers whose
+// total difficulty is not available locally instead of failing with
+// ErrMissingTD, but only if trusted reports them as coming from a trusted
+// source. Headers received from the network must never be trusted.
+func WithTrustExternOnMissingTD(trusted func(header *types.Header) bool) ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.trustExternOnMissingTD = trusted
+	}
+}
+
+// WithoutSelfishMiningProtection makes the fork chooser always keep the local
+// head if the extern header has the same total difficulty, regardless of its
+// height. This is only safe on networks with trusted block producers.
+func WithoutSelfishMiningProtection() ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.disableSelfishMiningProtection = true
+	}
+}
+
+func NewForkChoice(chainReader ChainReader, preserve func(header *types.Header) bool, opts ...ForkChoiceOption) *ForkChoice {
+	f, err := NewForkChoiceErr(chainReader, preserve, opts...)
 	if err != nil {
 		log.Crit("Failed to initialize random seed", "err", err)
 	}
-	return &ForkChoice{
-		chain:    chainReader,
-		rand:     mrand.New(mrand.NewSource(seed.Int64())),
-		preserve: preserve,
+	return f
+}
+
+// NewForkChoiceErr is like NewForkChoice, but returns an error instead of
+// exiting the process if the random generator can't be seeded.
+func NewForkChoiceErr(chainReader ChainReader, preserve func(header *types.Header) bool, opts ...ForkChoiceOption) (*ForkChoice, error) {
+	f := &ForkChoice{
+		chain:       chainReader,
+		config:      chainReader.Config(),
+		seedSource:  cryptoSource{},
+		preserve:    preserve,
+		tdCacheSize: defaultTdCacheSize,
+
+		reorgTieProbability: defaultReorgTieProbability,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	seed, err := f.seedSource.Seed()
+	if err != nil {
+		return nil, fmt.Errorf("failed to seed fork choice: %w", err)
+	}
+	f.rand = mrand.New(mrand.NewSource(seed))
+
+	if !(f.reorgTieProbability >= 0 && f.reorgTieProbability <= 1) {
+		log.Warn("Sanitizing invalid reorg tie probability", "provided", f.reorgTieProbability, "updated", defaultReorgTieProbability)
+		f.reorgTieProbability = defaultReorgTieProbability
+	}
+	if f.coinFlip == nil {
+		f.coinFlip, f.countFlips = f.randomCoinFlip, true
+	}
+	if f.tdCacheSize > 0 {
+		f.tdCache = lru.NewCache[tdCacheKey, *big.Int](f.tdCacheSize)
+	}
+	return f, nil
+}
+
+// NewForkChoiceSeeded creates a fork chooser whose random generator is seeded
+// from the genesis hash instead of crypto/rand, so that all nodes of a network
+// flip the same sequence of coins and their decisions can be reproduced.
+//
+// The flips are predictable by anyone who knows the genesis, which lets a
+// miner know upfront how a tie with its block will be broken. Only use it
+// where reproducibility outweighs that.
+func NewForkChoiceSeeded(chainReader ChainReader, preserve func(header *types.Header) bool, opts ...ForkChoiceOption) *ForkChoice {
+	genesis := chainReader.GetCanonicalHash(0)
+	seed := fixedSource(binary.BigEndian.Uint64(genesis[:8]))
+	return NewForkChoice(chainReader, preserve, append([]ForkChoiceOption{withRandSource(seed)}, opts...)...)
+}
+
+// randSource provides the seed of a fork chooser's random generator.
+type randSource interface {
+	Seed() (int64, error)
+}
+
+// cryptoSource is the default randSource, drawing seeds from crypto/rand.
+type cryptoSource struct{}
+
+func (cryptoSource) Seed() (int64, error) {
+	seed, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return 0, err
+	}
+	return seed.Int64(), nil
+}
+
+// fixedSource is a randSource always returning the same seed.
+type fixedSource int64
+
+func (s fixedSource) Seed() (int64, error) {
+	return int64(s), nil
+}
+
+// withRandSource overrides the source seeding the random generator, e.g. to
+// make the coin flips deterministic in tests.
+func withRandSource(source randSource) ForkChoiceOption {
+	return func(f *ForkChoice) {
+		f.seedSource = source
+	}
+}
+
+// randomCoinFlip is the default tie breaker, reorging with the configured
+// probability. Its outcomes are counted by tieBreak to allow auditing the
+// distribution.
+func (f *ForkChoice) randomCoinFlip() bool {
+	return f.rand.Float64() < f.reorgTieProbability
+}
+
+// ResetCache drops all memoized total difficulties. It must be called whenever
+// the underlying chain is mutated in a way that deletes or rewrites blocks,
+// e.g. on a rewind.
+func (f *ForkChoice) ResetCache() {
+	if f.tdCache != nil {
+		f.tdCache.Purge()
+	}
+}
+
+// chainView is the chain data a fork choice evaluation is run against.
+type chainView struct {
+	reader  ChainReader
+	config  *params.ChainConfig
+	tdCache *lru.Cache[tdCacheKey, *big.Int] // Memoized total difficulties, nil if disabled
+}
+
+// view returns the chain view backed by the fork chooser's own chain reader.
+func (f *ForkChoice) view() *chainView {
+	return &chainView{reader: f.chain, config: f.config, tdCache: f.tdCache}
+}
+
+// getTd retrieves the total difficulty of a block, serving it from the cache
+// if possible.
+func (v *chainView) getTd(hash common.Hash, number uint64) *big.Int {
+	if v.tdCache == nil {
+		return v.reader.GetTd(hash, number)
+	}
+	key := tdCacheKey{hash: hash, number: number}
+	if td, ok := v.tdCache.Get(key); ok {
+		return td
+	}
+	td := v.reader.GetTd(hash, number)
+	if td != nil {
+		v.tdCache.Add(key, td)
+	}
+	return td
+}
+
+// getDerivedTd computes the total difficulty of a block from its parent's, or
+// returns nil if the parent's is not available either.
+func (v *chainView) getDerivedTd(header *types.Header) *big.Int {
+	if header.Number.Sign() == 0 || header.Difficulty == nil {
+		return nil
+	}
+	parentTd := v.getTd(header.ParentHash, header.Number.Uint64()-1)
+	if parentTd == nil {
+		return nil
 	}
+	return new(big.Int).Add(parentTd, header.Difficulty)
 }
 
 // ReorgNeeded returns whether the reorg should be applied
@@ -75,39 +543,423 @@ func NewForkChoice(chainReader ChainReader, preserve func(header *types.Header)
 // total difficulty is higher. In the extern mode, the trusted
 // header is always selected as the head.
 func (f *ForkChoice) ReorgNeeded(current *types.Header, extern *types.Header) (bool, error) {
+	return f.ReorgNeededCtx(context.Background(), current, extern)
+}
+
+// ShouldAdopt is like ReorgNeeded, but evaluates the extern header against the
+// current head of the chain the fork chooser was created with.
+//
+// The head is taken from CurrentHeader. On a BlockChain that is the head of the
+// header chain, which may run far ahead of CurrentBlock during sync, so block
+// importers should call ReorgNeeded with the current block's header instead.
+func (f *ForkChoice) ShouldAdopt(extern *types.Header) (bool, error) {
+	return f.ReorgNeeded(f.chain.CurrentHeader(), extern)
+}
+
+// ReorgNeededCtx is like ReorgNeeded, but aborts with the context's error if
+// the context is cancelled before the evaluation hits the database.
+func (f *ForkChoice) ReorgNeededCtx(ctx context.Context, current *types.Header, extern *types.Header) (bool, error) {
+	res, err := f.safeEvaluate(ctx, f.view(), current, extern, false)
+	return res.Reorg, err
+}
+
+// ReorgNeededOn is like ReorgNeeded, but evaluates the headers against the given
+// chain reader instead of the one the fork chooser was created with, e.g. a
+// side chain view during sync. Total difficulties retrieved from it are not
+// cached.
+func (f *ForkChoice) ReorgNeededOn(reader ChainReader, current *types.Header, extern *types.Header) (bool, error) {
+	res, err := f.safeEvaluate(context.Background(), &chainView{reader: reader, config: reader.Config()}, current, extern, false)
+	return res.Reorg, err
+}
+
+// Evaluate is like ReorgNeeded, but returns the rule which decided the outcome
+// along with copies of the total difficulties compared.
+func (f *ForkChoice) Evaluate(current *types.Header, extern *types.Header) (ReorgResult, error) {
+	res, err := f.safeEvaluate(context.Background(), f.view(), current, extern, false)
+	return res.detached(), err
+}
+
+// evaluateQuiet implements quietForkChoicer, evaluating like Evaluate but
+// without updating metrics or logging the reorg ancestor.
+func (f *ForkChoice) evaluateQuiet(current *types.Header, extern *types.Header) (ReorgResult, error) {
+	return f.safeEvaluate(context.Background(), f.view(), current, extern, true)
+}
+
+// safeEvaluate evaluates the fork choice, converting any panic raised by
+// malformed input into an error instead of crashing block import. It is a last
+// line of defence, headers are still expected to be validated upfront. Quiet
+// evaluations leave the metrics untouched and don't log.
+func (f *ForkChoice) safeEvaluate(ctx context.Context, view *chainView, current *types.Header, extern *types.Header, quiet bool) (res ReorgResult, err error) {
+	if !quiet {
+		defer forkChoiceTdTimer.UpdateSince(time.Now())
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = ReorgResult{}, reorgPanicError(current, extern, r)
+		}
+	}()
+	local, err := f.loadLocal(ctx, view, current)
+	if err != nil {
+		return ReorgResult{}, err
+	}
+	local.quiet = quiet
+	if res, err = f.evaluate(ctx, &local, extern); res.Reorg && !quiet {
+		logReorgAncestor(ctx, view.reader, current, extern)
+	}
+	return res, err
+}
+
+// ReorgNeededChain evaluates a segment of external headers against the local
+// canonical head, returning the index of the first header which would trigger
+// a reorg, or -1 if none would. The local total difficulty is only looked up
+// once for the entire segment.
+func (f *ForkChoice) ReorgNeededChain(current *types.Header, externs []*types.Header) (index int, err error) {
+	var (
+		ctx    = context.Background()
+		extern *types.Header
+	)
+	defer func() {
+		if r := recover(); r != nil {
+			index, err = -1, reorgPanicError(current, extern, r)
+		}
+	}()
+	local, err := f.loadLocal(ctx, f.view(), current)
+	if err != nil {
+		return -1, err
+	}
+	for i := range externs {
+		extern = externs[i]
+
+		res, err := f.evaluate(ctx, &local, extern)
+		if err != nil {
+			return -1, err
+		}
+		if res.Reorg {
+			logReorgAncestor(ctx, local.view.reader, current, extern)
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// BestAgainst evaluates several competing external headers against the local
+// canonical head and returns the one which would end up as the head after
+// applying the fork choice to each of them in turn, or nil if the local head
+// prevails. Total difficulties are looked up only once per header. Trusted
+// headers without a known total difficulty are returned as soon as they win,
+// as they can't be compared any further.
+func (f *ForkChoice) BestAgainst(current *types.Header, externs []*types.Header) (best *types.Header, err error) {
+	var (
+		ctx    = context.Background()
+		extern *types.Header
+	)
+	defer func() {
+		if r := recover(); r != nil {
+			best, err = nil, reorgPanicError(current, extern, r)
+		}
+	}()
+	local, err := f.loadLocal(ctx, f.view(), current)
+	if err != nil {
+		return nil, err
+	}
+	for i := range externs {
+		extern = externs[i]
+
+		res, err := f.evaluate(ctx, &local, extern)
+		if err != nil {
+			return nil, err
+		}
+		if !res.Reorg {
+			continue
+		}
+		best = extern
+		if res.ExternTD == nil {
+			break
+		}
+		local = localHead{view: local.view, header: extern, hash: extern.Hash(), td: res.ExternTD}
+	}
+	return best, nil
+}
+
+// logReorgAncestor logs the common ancestor of the local head and an extern
+// header the fork chooser decided to reorg onto, if debug logging is enabled.
+// Extensions of the local head drop no blocks and are not logged.
+func logReorgAncestor(ctx context.Context, reader ChainReader, current *types.Header, extern *types.Header) {
+	if !log.Root().Enabled(ctx, log.LevelDebug) {
+		return
+	}
+	currentHash := current.Hash()
+	if extern.ParentHash == currentHash {
+		return
+	}
+	ancestor := findCommonAncestor(reader, current, extern, maxAncestorLookups)
+	if ancestor == nil {
+		log.Debug("Fork choice accepted reorg", "number", extern.Number, "hash", extern.Hash(), "ancestor", "unknown")
+		return
+	}
+	if ancestor.Hash() == currentHash {
+		return
+	}
+	log.Debug("Fork choice accepted reorg", "number", extern.Number, "hash", extern.Hash(),
+		"ancestor", ancestor.Number, "ancestorhash", ancestor.Hash(), "drop", new(big.Int).Sub(current.Number, ancestor.Number))
+}
+
+// findCommonAncestor walks back from two headers until their chains meet,
+// retrieving at most limit headers. It returns nil if the ancestor was not
+// found within the limit or a header along the way is unknown.
+func findCommonAncestor(reader ChainReader, a *types.Header, b *types.Header, limit int) *types.Header {
+	for hashA, hashB := a.Hash(), b.Hash(); hashA != hashB; {
+		if limit--; limit < 0 {
+			return nil
+		}
+		if a.Number.Cmp(b.Number) >= 0 {
+			if a = reader.GetHeaderByHash(a.ParentHash); a == nil {
+				return nil
+			}
+			hashA = a.Hash()
+		} else {
+			if b = reader.GetHeaderByHash(b.ParentHash); b == nil {
+				return nil
+			}
+			hashB = b.Hash()
+		}
+	}
+	return a
+}
+
+// reorgPanicError logs a panic recovered during fork choice along with the
+// offending headers and converts it into an error.
+func reorgPanicError(current *types.Header, extern *types.Header, r interface{}) error {
+	describe := func(header *types.Header) string {
+		if header == nil {
+			return "nil"
+		}
+		return fmt.Sprintf("#%v [%x]", header.Number, header.Hash())
+	}
+	log.Error("Fork choice evaluation panicked", "local", describe(current), "extern", describe(extern), "err", r)
+	return fmt.Errorf("fork choice panicked: %v", r)
+}
+
+// localHead is the local canonical head along with its hash and total
+// difficulty, retrieved once per evaluation from the chain view.
+type localHead struct {
+	view   *chainView
+	header *types.Header
+	hash   common.Hash
+	td     *big.Int
+	quiet  bool // Whether to skip updating the metrics
+}
+
+// loadLocal retrieves the hash and total difficulty of the local head.
+func (f *ForkChoice) loadLocal(ctx context.Context, view *chainView, current *types.Header) (localHead, error) {
+	if err := ValidateHeaderForForkChoice(current); err != nil {
+		return localHead{}, fmt.Errorf("local header: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return localHead{}, err
+	}
+	hash := current.Hash()
+	if f.checkCanonical && view.reader.GetCanonicalHash(current.Number.Uint64()) != hash {
+		return localHead{}, fmt.Errorf("%w: #%d [%x]", ErrNonCanonicalCurrent, current.Number, hash)
+	}
+	td := view.getTd(hash, current.Number.Uint64())
+	if td == nil {
+		return localHead{}, fmt.Errorf("%w: local block #%d [%x]", ErrMissingTD, current.Number, hash)
+	}
+	if !validTd(view.config, current, td) {
+		return localHead{}, fmt.Errorf("%w: local block #%d [%x]: %v", ErrCorruptTD, current.Number, hash, td)
+	}
+	return localHead{view: view, header: current, hash: hash, td: td}, nil
+}
+
+// evaluate is the internal version of Evaluate, which operates on an already
+// retrieved local head.
+func (f *ForkChoice) evaluate(ctx context.Context, local *localHead, extern *types.Header) (ReorgResult, error) {
+	res := ReorgResult{LocalTD: local.td}
+	if err := ValidateHeaderForForkChoice(extern); err != nil {
+		return res, fmt.Errorf("extern header: %w", err)
+	}
+	// There's nothing to decide if the extern header is the local head itself
+	externHash := extern.Hash()
+	if externHash == local.hash {
+		if extern.Number.Cmp(local.header.Number) != 0 {
+			log.Error("Fork choice hash collision", "hash", externHash, "local", local.header.Number, "extern", extern.Number)
+			return res, fmt.Errorf("%w: [%x] at #%d and #%d", ErrHashCollision, externHash, local.header.Number, extern.Number)
+		}
+		res.ExternTD = local.td
+		return res.decided(false, RuleSameHeader), nil
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
 	var (
-		localTD  = f.chain.GetTd(current.Hash(), current.Number.Uint64())
-		externTd = f.chain.GetTd(extern.Hash(), extern.Number.Uint64())
+		current = local.header
+		localTD = local.td
+		config  = local.view.config
 	)
-	if localTD == nil || externTd == nil {
-		return false, errors.New("missing td")
+	externTd := local.view.getTd(externHash, extern.Number.Uint64())
+	if externTd == nil && f.parentTdFallback {
+		externTd = local.view.getDerivedTd(extern)
+	}
+	if externTd == nil {
+		// Blocks below the pruning horizon may legitimately lack a total
+		// difficulty. They are far too old to reorg onto, so reject them.
+		if extern.Number.Uint64() < local.view.reader.PruningHorizon() {
+			return res.decided(false, RulePruned), nil
+		}
+		if f.trustExternOnMissingTD != nil && f.trustExternOnMissingTD(extern) {
+			return res.decided(true, RuleTrusted), nil
+		}
+		return res, fmt.Errorf("%w: extern block #%d [%x]", ErrMissingTD, extern.Number, externHash)
+	}
+	if !validTd(config, extern, externTd) {
+		return res, fmt.Errorf("%w: extern block #%d [%x]: %v", ErrCorruptTD, extern.Number, externHash, externTd)
+	}
+	res.ExternTD = externTd
+	if metrics.Enabled && !local.quiet {
+		forkChoiceTdGapHist.Update(tdGap(localTD, externTd))
+		forkChoiceLocalTdGauge.Update(clampTd(localTD))
+		forkChoiceExternTdGauge.Update(clampTd(externTd))
 	}
 	// Accept the new header as the chain head if the transition
 	// is already triggered. We assume all the headers after the
 	// transition come from the trusted consensus layer.
-	if ttd := f.chain.Config().TerminalTotalDifficulty; ttd != nil && ttd.Cmp(externTd) <= 0 {
-		return true, nil
+	if ttd := config.TerminalTotalDifficulty; ttd != nil && ttd.Cmp(externTd) <= 0 {
+		return res.decided(true, RuleTerminalTD), nil
 	}
 
 	// If the total difficulty is higher than our known, add it to the canonical chain
-	if diff := externTd.Cmp(localTD); diff > 0 {
-		return true, nil
+	diff := externTd.Cmp(localTD)
+	marginal := diff > 0 && f.marginal(current, localTD, extern, externTd)
+	if marginal && extern.Number.Cmp(current.Number) < 0 {
+		// Don't let the height rule below adopt a marginally heavier shorter chain
+		return res.decided(false, RuleMinTDAdvantage), nil
+	}
+	if diff > 0 && !marginal {
+		if f.sticky(current, localTD, extern, externTd) {
+			return res.decided(false, RuleStickyHead), nil
+		}
+		return res.decided(true, RuleTotalDifficulty), nil
 	} else if diff < 0 {
-		return false, nil
+		return res.decided(false, RuleTotalDifficulty), nil
+	}
+	// Local and external difficulty is identical, or close enough to be treated so.
+	if f.disableSelfishMiningProtection {
+		return res.decided(false, RuleEqualTD), nil
 	}
-	// Local and external difficulty is identical.
 	// Second clause in the if statement reduces the vulnerability to selfish mining.
 	// Please refer to http://www.cs.cornell.edu/~ie53/publications/btcProcFC.pdf
-	reorg := false
 	externNum, localNum := extern.Number.Uint64(), current.Number.Uint64()
-	if externNum < localNum {
-		reorg = true
-	} else if externNum == localNum {
-		var currentPreserve, externPreserve bool
-		if f.preserve != nil {
-			currentPreserve, externPreserve = f.preserve(current), f.preserve(extern)
+	if externNum != localNum {
+		return res.decided(externNum < localNum, RuleBlockNumber), nil
+	}
+	if f.preserve != nil {
+		if f.preserve(current) {
+			return res.decided(false, RulePreserve), nil
+		}
+		if f.preserve(extern) {
+			return res.decided(true, RulePreserve), nil
 		}
-		reorg = !currentPreserve && (externPreserve || f.rand.Float64() < 0.5)
 	}
-	return reorg, nil
+	if f.strictTies {
+		return res, fmt.Errorf("%w: local block #%d [%x], extern block #%d [%x]", ErrUnexpectedTie, current.Number, local.hash, extern.Number, externHash)
+	}
+	return res.decided(f.tieBreak(local, externHash), RuleTieBreak), nil
+}
+
+// tieBreak decides whether to reorg onto an extern header which has the same
+// total difficulty and height as the local head.
+func (f *ForkChoice) tieBreak(local *localHead, externHash common.Hash) bool {
+	if f.deterministicTies {
+		return bytes.Compare(externHash[:], local.hash[:]) < 0
+	}
+	reorg := f.coinFlip()
+	if f.countFlips && !local.quiet {
+		if reorg {
+			forkChoiceFlipReorgCounter.Inc(1)
+		} else {
+			forkChoiceFlipKeepCounter.Inc(1)
+		}
+	}
+	return reorg
+}
+
+// sticky reports whether a reorg onto a heavier extern header should be declined
+// because it's too close to the local head while not being heavier by enough.
+func (f *ForkChoice) sticky(current *types.Header, localTD *big.Int, extern *types.Header, externTd *big.Int) bool {
+	if f.stickyDepth == 0 || f.minTDAdvantage == nil || f.minTDAdvantage.Sign() <= 0 {
+		return false
+	}
+	// Headers ahead of the local head extend it rather than reorg it shallowly,
+	// declining them would stall the head until the tip is depth blocks ahead.
+	localNum, externNum := current.Number.Uint64(), extern.Number.Uint64()
+	if externNum > localNum || localNum-externNum >= f.stickyDepth {
+		return false
+	}
+	advantage := new(big.Int).Sub(externTd, localTD)
+	return advantage.Cmp(f.minTDAdvantage) < 0
+}
+
+// marginal reports whether a heavier extern total difficulty falls short of the
+// advantage required to win outright. Extern headers above the local head are
+// never marginal, otherwise the height rule would decline every extension of
+// the local chain adding less than the required advantage.
+func (f *ForkChoice) marginal(current *types.Header, localTD *big.Int, extern *types.Header, externTd *big.Int) bool {
+	if f.minReorgTDAdvantage == nil || f.minReorgTDAdvantage.Sign() <= 0 {
+		return false
+	}
+	if extern.Number.Cmp(current.Number) > 0 {
+		return false
+	}
+	advantage := new(big.Int).Sub(externTd, localTD)
+	return advantage.Cmp(f.minReorgTDAdvantage) < 0
+}
+
+// ValidateHeaderForForkChoice checks that a header carries the fields the fork
+// chooser relies on, allowing callers to reject malformed headers before they
+// reach ReorgNeeded.
+func ValidateHeaderForForkChoice(header *types.Header) error {
+	if header == nil {
+		return ErrNilHeader
+	}
+	if header.Number == nil {
+		return fmt.Errorf("%w: missing number", ErrIncompleteHeader)
+	}
+	if header.Number.Sign() < 0 {
+		return fmt.Errorf("%w: negative number %v", ErrIncompleteHeader, header.Number)
+	}
+	return nil
+}
+
+// validTd reports whether the total difficulty is one the block can have. It
+// can never be negative. It may only be zero for the genesis block, or if the
+// chain transitioned to proof-of-stake at a terminal total difficulty of zero.
+func validTd(config *params.ChainConfig, header *types.Header, td *big.Int) bool {
+	switch td.Sign() {
+	case 1:
+		return true
+	case -1:
+		return false
+	}
+	if header.Number.Sign() == 0 {
+		return true
+	}
+	ttd := config.TerminalTotalDifficulty
+	return ttd != nil && ttd.Sign() == 0
+}
+
+// clampTd returns a total difficulty clamped to the int64 range so it can be
+// reported in a gauge.
+func clampTd(td *big.Int) int64 {
+	if !td.IsInt64() {
+		return math.MaxInt64
+	}
+	return td.Int64()
+}
+
+// tdGap returns the absolute difference between two total difficulties,
+// clamped to the int64 range so it can be sampled into a histogram.
+func tdGap(localTD, externTd *big.Int) int64 {
+	gap := new(big.Int).Sub(externTd, localTD)
+	return clampTd(gap.Abs(gap))
 }
@@ -0,0 +1,1404 @@
+// Copyright 2024 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	mrand "math/rand"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/forkchoicetest"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestForkChoiceMissingTD(t *testing.T) {
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		known   = reader.NewHeader(1, 10, 0)
+		unknown = reader.NewHeader(1, -1, 1)
+		forker  = NewForkChoice(reader, nil)
+	)
+	if _, err := forker.ReorgNeeded(unknown, known); !errors.Is(err, ErrMissingTD) {
+		t.Errorf("missing local td: have %v, want %v", err, ErrMissingTD)
+	}
+	if _, err := forker.ReorgNeeded(known, unknown); !errors.Is(err, ErrMissingTD) {
+		t.Errorf("missing extern td: have %v, want %v", err, ErrMissingTD)
+	}
+	if _, err := forker.ReorgNeeded(known, known); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestForkChoiceSameHeader(t *testing.T) {
+	for _, config := range []*params.ChainConfig{params.TestChainConfig, params.MergedTestChainConfig} {
+		var (
+			flips  int
+			reader = forkchoicetest.NewReader(config)
+			header = reader.NewHeader(1, 10, 0)
+			forker = NewForkChoice(reader, nil, WithTdCacheSize(0), WithCoinFlip(func() bool { flips++; return true }))
+		)
+		reorg, err := forker.ReorgNeeded(header, header)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if reorg {
+			t.Errorf("ttd %v: reorged onto the local head", config.TerminalTotalDifficulty)
+		}
+		if flips != 0 || reader.TdReads != 1 {
+			t.Errorf("ttd %v: evaluation not short circuited: %d flips, %d reads", config.TerminalTotalDifficulty, flips, reader.TdReads)
+		}
+	}
+}
+
+func TestForkChoiceConfigCached(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.MergedTestChainConfig)
+		local  = reader.NewHeader(1, 0, 0)
+		extern = reader.NewHeader(1, 0, 1)
+		forker = NewForkChoice(reader, nil)
+	)
+	for i := 0; i < 10; i++ {
+		forker.ReorgNeeded(local, extern)
+		forker.ReorgNeeded(local, reader.NewHeader(2, 0, 0))
+	}
+	if reader.ConfigReads != 1 {
+		t.Fatalf("config reads mismatch: have %d, want %d", reader.ConfigReads, 1)
+	}
+}
+
+func TestForkChoiceCanonicalCheck(t *testing.T) {
+	var (
+		reader    = forkchoicetest.NewReader(params.TestChainConfig)
+		canonical = reader.NewHeader(1, 10, 0)
+		stale     = reader.NewHeader(1, 10, 1)
+		extern    = reader.NewHeader(2, 20, 2)
+	)
+	reader.Canon[1] = canonical.Hash()
+
+	// Disabled by default, any local header is accepted
+	forker := NewForkChoice(reader, nil)
+	if reorg, err := forker.ReorgNeeded(stale, extern); err != nil || !reorg {
+		t.Fatalf("unchecked: have %v/%v, want true/nil", reorg, err)
+	}
+	// Enabled, only the canonical header is accepted
+	forker = NewForkChoice(reader, nil, WithCanonicalCheck())
+	if reorg, err := forker.ReorgNeeded(canonical, extern); err != nil || !reorg {
+		t.Fatalf("canonical: have %v/%v, want true/nil", reorg, err)
+	}
+	if _, err := forker.ReorgNeeded(stale, extern); !errors.Is(err, ErrNonCanonicalCurrent) {
+		t.Fatalf("non-canonical: error mismatch: have %v, want %v", err, ErrNonCanonicalCurrent)
+	}
+}
+
+func TestForkChoiceParentTdFallback(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		parent = reader.NewHeader(1, 10, 0)
+		local  = reader.NewHeader(2, 11, 1)
+		orphan = reader.NewHeader(2, -1, 2)
+	)
+	child := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     big.NewInt(2),
+		Difficulty: big.NewInt(2),
+	}
+	// The fallback is disabled by default
+	forker := NewForkChoice(reader, nil)
+	if _, err := forker.ReorgNeeded(local, child); !errors.Is(err, ErrMissingTD) {
+		t.Fatalf("disabled fallback: error mismatch: have %v, want %v", err, ErrMissingTD)
+	}
+	// The enabled fallback derives the td from the parent: 10 + 2 > 11
+	forker = NewForkChoice(reader, nil, WithParentTdFallback())
+	if reorg, err := forker.ReorgNeeded(local, child); err != nil || !reorg {
+		t.Fatalf("enabled fallback: have %v/%v, want true/nil", reorg, err)
+	}
+	// Headers with an unknown parent still fail
+	if _, err := forker.ReorgNeeded(local, orphan); !errors.Is(err, ErrMissingTD) {
+		t.Fatalf("missing parent: error mismatch: have %v, want %v", err, ErrMissingTD)
+	}
+}
+
+func TestForkChoicePruningHorizon(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(100, 1000, 0)
+		below  = reader.NewHeader(49, -1, 1)
+		above  = reader.NewHeader(50, -1, 2)
+		forker = NewForkChoice(reader, nil)
+	)
+	reader.Horizon = 50
+
+	// Candidates with a pruned td are rejected without an error
+	if reorg, err := forker.ReorgNeeded(local, below); err != nil || reorg {
+		t.Errorf("below horizon: have %v/%v, want false/nil", reorg, err)
+	}
+	// Candidates at or above the horizon must still have a td
+	if _, err := forker.ReorgNeeded(local, above); !errors.Is(err, ErrMissingTD) {
+		t.Errorf("above horizon: error mismatch: have %v, want %v", err, ErrMissingTD)
+	}
+	// A missing local td is never tolerated
+	if _, err := forker.ReorgNeeded(below, local); !errors.Is(err, ErrMissingTD) {
+		t.Errorf("pruned local: error mismatch: have %v, want %v", err, ErrMissingTD)
+	}
+}
+
+func TestForkChoiceReorgAncestorLog(t *testing.T) {
+	var (
+		reader   = forkchoicetest.NewReader(params.TestChainConfig)
+		ancestor = reader.NewHeader(1, 10, 0)
+		local    = reader.NewChild(reader.NewChild(ancestor, 11, 1), 12, 1)
+		extern   = reader.NewChild(reader.NewChild(reader.NewChild(ancestor, 11, 2), 12, 2), 13, 2)
+		forker   = NewForkChoice(reader, nil)
+		buf      bytes.Buffer
+	)
+	defer log.SetDefault(log.Root())
+	log.SetDefault(log.NewLogger(log.LogfmtHandlerWithLevel(&buf, log.LevelDebug)))
+
+	// Declined reorgs don't walk the chain
+	if reorg, err := forker.ReorgNeeded(extern, local); err != nil || reorg {
+		t.Fatalf("lighter extern: have %v/%v, want false/nil", reorg, err)
+	}
+	if buf.Len() != 0 || reader.HeaderReads != 0 {
+		t.Fatalf("declined reorg walked %d headers: %s", reader.HeaderReads, buf.String())
+	}
+	// Extensions of the local head are not reorgs
+	child := reader.NewChild(local, 13, 3)
+	if reorg, err := forker.ReorgNeeded(local, child); err != nil || !reorg {
+		t.Fatalf("child extern: have %v/%v, want true/nil", reorg, err)
+	}
+	if reorg, err := forker.ReorgNeeded(local, reader.NewChild(child, 14, 3)); err != nil || !reorg {
+		t.Fatalf("grandchild extern: have %v/%v, want true/nil", reorg, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("extension logged as reorg: %s", buf.String())
+	}
+	reader.HeaderReads = 0
+
+	// Accepted reorgs log the common ancestor
+	if reorg, err := forker.ReorgNeeded(local, extern); err != nil || !reorg {
+		t.Fatalf("heavier extern: have %v/%v, want true/nil", reorg, err)
+	}
+	if reader.HeaderReads != 5 {
+		t.Errorf("header reads mismatch: have %d, want %d", reader.HeaderReads, 5)
+	}
+	for _, field := range []string{"ancestor=1", "ancestorhash=" + ancestor.Hash().Hex(), "drop=2"} {
+		if !strings.Contains(buf.String(), field) {
+			t.Errorf("log missing %q: %s", field, buf.String())
+		}
+	}
+	// The walk is bounded
+	if found := findCommonAncestor(reader, local, extern, 4); found != nil {
+		t.Errorf("bounded walk found ancestor #%d", found.Number)
+	}
+	if found := findCommonAncestor(reader, local, extern, 5); found == nil || found.Hash() != ancestor.Hash() {
+		t.Errorf("ancestor mismatch: have %v, want #%d", found, ancestor.Number)
+	}
+}
+
+// Tests that the fork choice, including the ancestor walk, runs on a database
+// holding only headers and total difficulties, as during header-first sync.
+func TestForkChoiceHeaderOnly(t *testing.T) {
+	var (
+		reader = &dbChainReader{config: params.TestChainConfig, db: rawdb.NewMemoryDatabase()}
+		write  = func(parent *types.Header, extra byte) *types.Header {
+			header := &types.Header{
+				ParentHash: parent.Hash(),
+				Number:     new(big.Int).Add(parent.Number, common.Big1),
+				Difficulty: big.NewInt(1),
+				Extra:      []byte{extra},
+			}
+			td := rawdb.ReadTd(reader.db, parent.Hash(), parent.Number.Uint64())
+			rawdb.WriteHeader(reader.db, header)
+			rawdb.WriteTd(reader.db, header.Hash(), header.Number.Uint64(), new(big.Int).Add(td, header.Difficulty))
+			return header
+		}
+		genesis = &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1)}
+	)
+	rawdb.WriteHeader(reader.db, genesis)
+	rawdb.WriteTd(reader.db, genesis.Hash(), 0, big.NewInt(1))
+
+	local := write(write(genesis, 1), 1)
+	extern := write(write(write(genesis, 2), 2), 2)
+	for _, header := range []*types.Header{local, extern} {
+		if rawdb.ReadBody(reader.db, header.Hash(), header.Number.Uint64()) != nil {
+			t.Fatalf("body stored for header #%d", header.Number)
+		}
+	}
+	var buf bytes.Buffer
+	defer log.SetDefault(log.Root())
+	log.SetDefault(log.NewLogger(log.LogfmtHandlerWithLevel(&buf, log.LevelDebug)))
+
+	if reorg, err := NewForkChoice(reader, nil).ReorgNeeded(local, extern); err != nil || !reorg {
+		t.Fatalf("heavier extern: have %v/%v, want true/nil", reorg, err)
+	}
+	if !strings.Contains(buf.String(), "ancestor=0") {
+		t.Errorf("ancestor not found on header-only data: %s", buf.String())
+	}
+}
+
+func TestForkChoiceTrustExternOnMissingTD(t *testing.T) {
+	var (
+		reader    = forkchoicetest.NewReader(params.TestChainConfig)
+		local     = reader.NewHeader(1, 10, 0)
+		trusted   = reader.NewHeader(2, -1, 1)
+		untrusted = reader.NewHeader(2, -1, 2)
+		forker    = NewForkChoice(reader, nil, WithTrustExternOnMissingTD(func(header *types.Header) bool {
+			return header == trusted
+		}))
+	)
+	if reorg, err := forker.ReorgNeeded(local, trusted); err != nil || !reorg {
+		t.Errorf("trusted extern: have %v/%v, want true/nil", reorg, err)
+	}
+	if _, err := forker.ReorgNeeded(local, untrusted); !errors.Is(err, ErrMissingTD) {
+		t.Errorf("untrusted extern: error mismatch: have %v, want %v", err, ErrMissingTD)
+	}
+	// Trusted headers are still rejected without the option
+	if _, err := NewForkChoice(reader, nil).ReorgNeeded(local, trusted); !errors.Is(err, ErrMissingTD) {
+		t.Errorf("disabled trust: error mismatch: have %v, want %v", err, ErrMissingTD)
+	}
+}
+
+func TestForkChoiceCorruptTD(t *testing.T) {
+	tests := []struct {
+		config   *params.ChainConfig
+		number   uint64
+		td       int64
+		corrupts bool
+	}{
+		{params.TestChainConfig, 1, -1, true},
+		{params.TestChainConfig, 0, -1, true},
+		{params.TestChainConfig, 1, 0, true},
+		{params.TestChainConfig, 0, 0, false},                // zero-difficulty genesis
+		{params.MergedTestChainConfig, 1, 0, false},          // merged at a ttd of zero
+		{params.MergedTestChainConfig, 1, -1, true},          // merged, but still negative
+		{params.AllCliqueProtocolChanges, 1, 0, true},        // pre-merge poa chain
+		{params.AllCliqueProtocolChanges, 1, 1, false},       // out-of-turn poa block
+		{params.AllCliqueProtocolChanges, 1000, 1200, false}, // mixed poa blocks
+	}
+	for i, tt := range tests {
+		var (
+			reader  = forkchoicetest.NewReader(tt.config)
+			valid   = reader.NewHeader(tt.number, 1, 0)
+			corrupt = reader.NewHeader(tt.number, 0, 1)
+			forker  = NewForkChoice(reader, nil)
+		)
+		reader.TDs[corrupt.Hash()] = big.NewInt(tt.td)
+
+		for _, pair := range [][2]*types.Header{{valid, corrupt}, {corrupt, valid}} {
+			_, err := forker.ReorgNeeded(pair[0], pair[1])
+			if corrupts := errors.Is(err, ErrCorruptTD); corrupts != tt.corrupts {
+				t.Errorf("test %d: corruption mismatch: have %v (%v), want %v", i, corrupts, err, tt.corrupts)
+			}
+		}
+	}
+}
+
+func TestForkChoiceNilHeader(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		header = reader.NewHeader(1, 10, 0)
+		forker = NewForkChoice(reader, nil)
+	)
+	for i, pair := range [][2]*types.Header{{nil, header}, {header, nil}, {nil, nil}} {
+		reorg, err := forker.ReorgNeeded(pair[0], pair[1])
+		if !errors.Is(err, ErrNilHeader) {
+			t.Errorf("case %d: error mismatch: have %v, want %v", i, err, ErrNilHeader)
+		}
+		if reorg {
+			t.Errorf("case %d: unexpected reorg", i)
+		}
+	}
+}
+
+func TestForkChoiceHashCollision(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 10, 0)
+		extern = reader.NewHeader(2, 20, 1)
+		forker = NewForkChoice(reader, nil)
+	)
+	// Real headers can't collide, forge a local head carrying the extern hash
+	head := localHead{view: forker.view(), header: local, hash: extern.Hash(), td: big.NewInt(10)}
+	res, err := forker.evaluate(context.Background(), &head, extern)
+	if !errors.Is(err, ErrHashCollision) {
+		t.Fatalf("error mismatch: have %v, want %v", err, ErrHashCollision)
+	}
+	if res.Reorg {
+		t.Fatalf("reorged onto colliding header")
+	}
+}
+
+func TestValidateHeaderForForkChoice(t *testing.T) {
+	tests := []struct {
+		header *types.Header
+		err    error
+	}{
+		{nil, ErrNilHeader},
+		{&types.Header{}, ErrIncompleteHeader},
+		{&types.Header{Number: big.NewInt(-1)}, ErrIncompleteHeader},
+		{&types.Header{Number: big.NewInt(0)}, nil},
+		{&types.Header{Number: big.NewInt(1)}, nil},
+	}
+	for i, tt := range tests {
+		if err := ValidateHeaderForForkChoice(tt.header); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	// The fork chooser rejects incomplete headers instead of panicking
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		header = reader.NewHeader(1, 10, 0)
+		forker = NewForkChoice(reader, nil)
+	)
+	for i, pair := range [][2]*types.Header{{&types.Header{}, header}, {header, &types.Header{}}} {
+		if _, err := forker.ReorgNeeded(pair[0], pair[1]); !errors.Is(err, ErrIncompleteHeader) {
+			t.Errorf("case %d: error mismatch: have %v, want %v", i, err, ErrIncompleteHeader)
+		}
+	}
+}
+
+func TestForkChoiceReorgNeededCtx(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 10, 0)
+		extern = reader.NewHeader(1, 20, 1)
+		forker = NewForkChoice(reader, nil)
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	if reorg, err := forker.ReorgNeededCtx(ctx, local, extern); err != nil || !reorg {
+		t.Fatalf("live context: have %v/%v, want true/nil", reorg, err)
+	}
+	cancel()
+	forker.ResetCache()
+	reader.TdReads = 0
+
+	if _, err := forker.ReorgNeededCtx(ctx, local, extern); !errors.Is(err, context.Canceled) {
+		t.Fatalf("error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	if reader.TdReads != 0 {
+		t.Fatalf("database accessed after cancellation: %d reads", reader.TdReads)
+	}
+}
+
+func TestForkChoiceReorgNeededOn(t *testing.T) {
+	var (
+		stored  = forkchoicetest.NewReader(params.TestChainConfig)
+		local   = stored.NewHeader(1, 10, 0)
+		extern  = stored.NewHeader(1, 20, 1)
+		passed  = forkchoicetest.NewReader(params.TestChainConfig)
+		forker  = NewForkChoice(stored, nil)
+		prepass = stored.TdReads
+	)
+	// The passed reader considers the local header heavier
+	passed.TDs[local.Hash()] = big.NewInt(30)
+	passed.TDs[extern.Hash()] = big.NewInt(20)
+
+	if reorg, err := forker.ReorgNeededOn(passed, local, extern); err != nil || reorg {
+		t.Fatalf("passed reader: have %v/%v, want false/nil", reorg, err)
+	}
+	if passed.TdReads != 2 || stored.TdReads != prepass {
+		t.Fatalf("td source mismatch: passed reads %d, stored reads %d", passed.TdReads, stored.TdReads-prepass)
+	}
+	// The stored reader and its cache are unaffected
+	if reorg, err := forker.ReorgNeeded(local, extern); err != nil || !reorg {
+		t.Fatalf("stored reader: have %v/%v, want true/nil", reorg, err)
+	}
+	if reorg, err := forker.ReorgNeededOn(passed, local, extern); err != nil || reorg {
+		t.Fatalf("passed reader after caching: have %v/%v, want false/nil", reorg, err)
+	}
+}
+
+func TestForkChoiceReorgNeededChain(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(3, 30, 0)
+		lower1 = reader.NewHeader(3, 10, 1)
+		lower2 = reader.NewHeader(3, 20, 1)
+		higher = reader.NewHeader(4, 40, 1)
+	)
+	tests := []struct {
+		externs []*types.Header
+		want    int
+	}{
+		{nil, -1},
+		{[]*types.Header{lower1, lower2}, -1},
+		{[]*types.Header{higher, lower1}, 0},
+		{[]*types.Header{lower1, lower2, higher, lower1}, 2},
+	}
+	for i, tt := range tests {
+		reader.TdReads = 0
+		forker := NewForkChoice(reader, nil, WithTdCacheSize(0))
+		index, err := forker.ReorgNeededChain(local, tt.externs)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		if index != tt.want {
+			t.Errorf("test %d: index mismatch: have %d, want %d", i, index, tt.want)
+		}
+		// The local td is read once, the externs up to the first accepted one
+		evaluated := len(tt.externs)
+		if tt.want >= 0 {
+			evaluated = tt.want + 1
+		}
+		if reader.TdReads != 1+evaluated {
+			t.Errorf("test %d: database reads mismatch: have %d, want %d", i, reader.TdReads, 1+evaluated)
+		}
+	}
+	// Errors on any extern header abort the evaluation
+	forker := NewForkChoice(reader, nil)
+	if _, err := forker.ReorgNeededChain(local, []*types.Header{lower1, nil}); !errors.Is(err, ErrNilHeader) {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrNilHeader)
+	}
+}
+
+func TestForkChoiceShouldAdopt(t *testing.T) {
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		genesis = reader.NewHeader(0, 1, 0)
+		local   = reader.NewChain(genesis, 2, 1)
+		forker  = NewForkChoice(reader, nil, WithDeterministicTies())
+	)
+	// Without a head there's nothing to compare against
+	if _, err := forker.ShouldAdopt(local[1]); !errors.Is(err, ErrNilHeader) {
+		t.Fatalf("error mismatch: have %v, want %v", err, ErrNilHeader)
+	}
+	reader.SetCanonical(genesis)
+	reader.SetCanonical(local...)
+
+	for i, extern := range []*types.Header{
+		reader.NewChain(genesis, 3, 2)[2],
+		reader.NewChain(genesis, 1, 3)[0],
+		reader.NewChain(genesis, 2, 4)[1],
+		local[1],
+	} {
+		want, wantErr := forker.ReorgNeeded(local[1], extern)
+		have, err := forker.ShouldAdopt(extern)
+		if have != want || err != wantErr {
+			t.Errorf("extern %d: decision mismatch: have %v/%v, want %v/%v", i, have, err, want, wantErr)
+		}
+	}
+}
+
+func TestForkChoiceBestAgainst(t *testing.T) {
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		local   = reader.NewHeader(10, 100, 0)
+		lighter = reader.NewHeader(10, 90, 1)
+		heavier = reader.NewHeader(11, 110, 2)
+		best    = reader.NewHeader(12, 120, 3)
+		middle  = reader.NewHeader(11, 115, 4)
+		forker  = NewForkChoice(reader, nil)
+	)
+	tests := []struct {
+		externs []*types.Header
+		best    *types.Header
+	}{
+		{nil, nil},
+		{[]*types.Header{lighter}, nil},
+		{[]*types.Header{lighter, heavier, local}, heavier},
+		{[]*types.Header{heavier, lighter, best, middle}, best},
+		{[]*types.Header{middle, heavier}, middle},
+	}
+	for i, tt := range tests {
+		have, err := forker.BestAgainst(local, tt.externs)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		if have != tt.best {
+			t.Errorf("test %d: best mismatch: have %v, want %v", i, have, tt.best)
+		}
+	}
+	// Winners are not looked up again when compared against later headers
+	forker = NewForkChoice(reader, nil, WithTdCacheSize(0))
+	reader.TdReads = 0
+	if _, err := forker.BestAgainst(local, []*types.Header{heavier, lighter, best, middle}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reader.TdReads != 5 {
+		t.Errorf("database reads mismatch: have %d, want %d", reader.TdReads, 5)
+	}
+	// Errors abort the evaluation
+	if _, err := forker.BestAgainst(local, []*types.Header{heavier, nil}); !errors.Is(err, ErrNilHeader) {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrNilHeader)
+	}
+}
+
+func TestForkChoiceCoinFlip(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 10, 0)
+		extern = reader.NewHeader(1, 10, 1)
+	)
+	for _, flip := range []bool{true, false} {
+		var (
+			flips  int
+			forker = NewForkChoice(reader, nil, WithCoinFlip(func() bool { flips++; return flip }))
+		)
+		for i := 0; i < 10; i++ {
+			reorg, err := forker.ReorgNeeded(local, extern)
+			if err != nil {
+				t.Fatalf("flip %v: unexpected error: %v", flip, err)
+			}
+			if reorg != flip {
+				t.Fatalf("flip %v: reorg mismatch: have %v, want %v", flip, reorg, flip)
+			}
+		}
+		if flips != 10 {
+			t.Fatalf("flip %v: coin flips mismatch: have %d, want %d", flip, flips, 10)
+		}
+	}
+	// Preserved headers take precedence over the coin flip
+	var (
+		preserve = func(header *types.Header) bool { return header == local }
+		forker   = NewForkChoice(reader, preserve, WithCoinFlip(func() bool { return true }))
+	)
+	if reorg, _ := forker.ReorgNeeded(local, extern); reorg {
+		t.Fatalf("reorged away from preserved header")
+	}
+}
+
+func TestForkChoiceReorgTieProbability(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 10, 0)
+		extern = reader.NewHeader(1, 10, 1)
+	)
+	for _, p := range []float64{0, 1} {
+		forker := NewForkChoice(reader, nil, WithReorgTieProbability(p))
+		for i := 0; i < 100; i++ {
+			if reorg, _ := forker.ReorgNeeded(local, extern); reorg != (p == 1) {
+				t.Fatalf("probability %v: reorg mismatch: have %v, want %v", p, reorg, p == 1)
+			}
+		}
+	}
+	for _, p := range []float64{-0.1, 1.1, math.NaN()} {
+		forker := NewForkChoice(reader, nil, WithReorgTieProbability(p))
+		if forker.reorgTieProbability != defaultReorgTieProbability {
+			t.Errorf("probability %v: not sanitized: have %v, want %v", p, forker.reorgTieProbability, defaultReorgTieProbability)
+		}
+	}
+}
+
+func TestForkChoiceDeterministicTies(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		a      = reader.NewHeader(1, 10, 0)
+		b      = reader.NewHeader(1, 10, 1)
+	)
+	lower, higher := a, b
+	if bytes.Compare(b.Hash().Bytes(), a.Hash().Bytes()) < 0 {
+		lower, higher = b, a
+	}
+	// Deterministic mode always settles on the lower hash
+	forker := NewForkChoice(reader, nil, WithDeterministicTies())
+	for i := 0; i < 100; i++ {
+		if reorg, _ := forker.ReorgNeeded(higher, lower); !reorg {
+			t.Fatalf("evaluation %d: declined reorg onto lower hash", i)
+		}
+		if reorg, _ := forker.ReorgNeeded(lower, higher); reorg {
+			t.Fatalf("evaluation %d: accepted reorg onto higher hash", i)
+		}
+	}
+	// Preserved headers still take precedence
+	forker = NewForkChoice(reader, func(header *types.Header) bool { return header == higher }, WithDeterministicTies())
+	if reorg, _ := forker.ReorgNeeded(higher, lower); reorg {
+		t.Fatalf("reorged away from preserved header")
+	}
+	// The coin flip remains the default, flip-flopping between the two
+	var (
+		accepted, declined int
+		random             = NewForkChoice(reader, nil)
+	)
+	for i := 0; i < 200; i++ {
+		if reorg, _ := random.ReorgNeeded(higher, lower); reorg {
+			accepted++
+		} else {
+			declined++
+		}
+	}
+	if accepted == 0 || declined == 0 {
+		t.Fatalf("coin flip not random: %d accepted, %d declined", accepted, declined)
+	}
+}
+
+func TestForkChoiceEvaluate(t *testing.T) {
+	var (
+		reader   = forkchoicetest.NewReader(params.TestChainConfig)
+		local    = reader.NewHeader(5, 10, 0)
+		sibling  = reader.NewHeader(5, 10, 1)
+		lower    = reader.NewHeader(4, 10, 2)
+		lighter  = reader.NewHeader(6, 9, 3)
+		heavier  = reader.NewHeader(6, 11, 4)
+		pruned   = reader.NewHeader(1, -1, 5)
+		unknown  = reader.NewHeader(6, -1, 6)
+		nearby   = reader.NewHeader(4, 11, 7)
+		terminal = forkchoicetest.NewReader(params.MergedTestChainConfig)
+	)
+	reader.Horizon = 2
+	terminal.TDs[local.Hash()] = big.NewInt(10)
+	terminal.TDs[lighter.Hash()] = big.NewInt(9)
+
+	tests := []struct {
+		reader   ChainReader
+		opts     []ForkChoiceOption
+		preserve func(*types.Header) bool
+		extern   *types.Header
+		reorg    bool
+		rule     int
+		externTd *big.Int
+	}{
+		{reader, nil, nil, local, false, RuleSameHeader, big.NewInt(10)},
+		{reader, nil, nil, pruned, false, RulePruned, nil},
+		{reader, []ForkChoiceOption{WithTrustExternOnMissingTD(func(*types.Header) bool { return true })}, nil, unknown, true, RuleTrusted, nil},
+		{terminal, nil, nil, lighter, true, RuleTerminalTD, big.NewInt(9)},
+		{reader, nil, nil, heavier, true, RuleTotalDifficulty, big.NewInt(11)},
+		{reader, nil, nil, lighter, false, RuleTotalDifficulty, big.NewInt(9)},
+		{reader, []ForkChoiceOption{WithStickyHead(2, big.NewInt(2))}, nil, nearby, false, RuleStickyHead, big.NewInt(11)},
+		{reader, []ForkChoiceOption{WithStickyHead(2, big.NewInt(2))}, nil, heavier, true, RuleTotalDifficulty, big.NewInt(11)},
+		{reader, []ForkChoiceOption{WithoutSelfishMiningProtection()}, nil, lower, false, RuleEqualTD, big.NewInt(10)},
+		{reader, nil, nil, lower, true, RuleBlockNumber, big.NewInt(10)},
+		{reader, nil, func(h *types.Header) bool { return h == local }, sibling, false, RulePreserve, big.NewInt(10)},
+		{reader, nil, func(h *types.Header) bool { return h == sibling }, sibling, true, RulePreserve, big.NewInt(10)},
+		{reader, []ForkChoiceOption{WithCoinFlip(func() bool { return true })}, nil, sibling, true, RuleTieBreak, big.NewInt(10)},
+		{reader, []ForkChoiceOption{WithCoinFlip(func() bool { return false })}, nil, sibling, false, RuleTieBreak, big.NewInt(10)},
+	}
+	for i, tt := range tests {
+		res, err := NewForkChoice(tt.reader, tt.preserve, tt.opts...).Evaluate(local, tt.extern)
+		if err != nil {
+			t.Fatalf("test %d: evaluation failed: %v", i, err)
+		}
+		if res.Reorg != tt.reorg || res.Rule != tt.rule {
+			t.Errorf("test %d: outcome mismatch: have %v/%d, want %v/%d", i, res.Reorg, res.Rule, tt.reorg, tt.rule)
+		}
+		if res.LocalTD == nil || res.LocalTD.Int64() != 10 {
+			t.Errorf("test %d: local td mismatch: have %v, want 10", i, res.LocalTD)
+		}
+		if (res.ExternTD == nil) != (tt.externTd == nil) || (tt.externTd != nil && res.ExternTD.Cmp(tt.externTd) != 0) {
+			t.Errorf("test %d: extern td mismatch: have %v, want %v", i, res.ExternTD, tt.externTd)
+		}
+	}
+	// Failed evaluations report no rule
+	if res, err := NewForkChoice(reader, nil).Evaluate(local, unknown); err == nil || res.Rule != 0 || res.Reorg {
+		t.Errorf("missing td: have %+v/%v, want no rule and an error", res, err)
+	}
+}
+
+func TestForkChoiceStrictTies(t *testing.T) {
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		local   = reader.NewHeader(2, 10, 0)
+		sibling = reader.NewHeader(2, 10, 1)
+		lower   = reader.NewHeader(1, 10, 2)
+		strict  = NewForkChoice(reader, nil, WithStrictTies(), WithDeterministicTies())
+	)
+	if _, err := strict.ReorgNeeded(local, sibling); !errors.Is(err, ErrUnexpectedTie) {
+		t.Fatalf("strict tie: error mismatch: have %v, want %v", err, ErrUnexpectedTie)
+	}
+	// Ties decided before the tie breaker are unaffected
+	if reorg, err := strict.ReorgNeeded(local, lower); err != nil || !reorg {
+		t.Fatalf("lower extern: have %v/%v, want true/nil", reorg, err)
+	}
+	preserving := NewForkChoice(reader, func(h *types.Header) bool { return h == local }, WithStrictTies())
+	if reorg, err := preserving.ReorgNeeded(local, sibling); err != nil || reorg {
+		t.Fatalf("preserved local: have %v/%v, want false/nil", reorg, err)
+	}
+	// Without strict mode the tie breaker decides as usual
+	want := bytes.Compare(sibling.Hash().Bytes(), local.Hash().Bytes()) < 0
+	if reorg, err := NewForkChoice(reader, nil, WithDeterministicTies()).ReorgNeeded(local, sibling); err != nil || reorg != want {
+		t.Fatalf("lenient tie: have %v/%v, want %v/nil", reorg, err, want)
+	}
+}
+
+// Tests the fork choice right at the terminal total difficulty. Headers reaching
+// it are adopted unconditionally, those just below still go through the full
+// total difficulty rules.
+func TestForkChoiceTerminalTDBoundary(t *testing.T) {
+	config := *params.TestChainConfig
+	config.TerminalTotalDifficulty = big.NewInt(100)
+
+	var (
+		reader = forkchoicetest.NewReader(&config)
+		local  = reader.NewHeader(10, 99, 0)
+		forker = NewForkChoice(reader, nil, WithCoinFlip(func() bool { return false }))
+	)
+	tests := []struct {
+		number uint64
+		td     int64
+		reorg  bool
+		rule   int
+	}{
+		{11, 100, true, RuleTerminalTD},
+		{9, 100, true, RuleTerminalTD},
+		{11, 101, true, RuleTerminalTD},
+		{10, 99, false, RuleTieBreak},
+		{9, 99, true, RuleBlockNumber},
+		{11, 98, false, RuleTotalDifficulty},
+	}
+	for i, tt := range tests {
+		res, err := forker.Evaluate(local, reader.NewHeader(tt.number, tt.td, byte(i+1)))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		if res.Reorg != tt.reorg || res.Rule != tt.rule {
+			t.Errorf("test %d: outcome mismatch: have %v/%d, want %v/%d", i, res.Reorg, res.Rule, tt.reorg, tt.rule)
+		}
+	}
+}
+
+func TestForkChoiceWithoutSelfishMiningProtection(t *testing.T) {
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		local   = reader.NewHeader(2, 10, 0)
+		sibling = reader.NewHeader(2, 10, 1)
+		shorter = reader.NewHeader(1, 10, 2)
+		heavier = reader.NewHeader(2, 11, 3)
+		forker  = NewForkChoice(reader, func(header *types.Header) bool { return header == sibling },
+			WithoutSelfishMiningProtection(), WithCoinFlip(func() bool { return true }))
+	)
+	// Exact ties never reorg, even onto lower or preserved headers
+	for i := 0; i < 100; i++ {
+		if reorg, err := forker.ReorgNeeded(local, sibling); err != nil || reorg {
+			t.Fatalf("evaluation %d: same height tie: have %v/%v, want false/nil", i, reorg, err)
+		}
+		if reorg, err := forker.ReorgNeeded(local, shorter); err != nil || reorg {
+			t.Fatalf("evaluation %d: lower height tie: have %v/%v, want false/nil", i, reorg, err)
+		}
+	}
+	// Higher total difficulty still wins
+	if reorg, err := forker.ReorgNeeded(local, heavier); err != nil || !reorg {
+		t.Fatalf("heavier extern: have %v/%v, want true/nil", reorg, err)
+	}
+}
+
+func TestForkChoiceStickyHead(t *testing.T) {
+	reader := forkchoicetest.NewReader(params.TestChainConfig)
+	local := reader.NewHeader(100, 1000, 0)
+
+	tests := []struct {
+		depth     uint64
+		advantage int64
+		number    uint64
+		td        int64
+		reorg     bool
+	}{
+		// Disabled by default
+		{0, 0, 101, 1001, true},
+		{0, 10, 101, 1001, true},
+		{4, 0, 101, 1001, true},
+
+		// Headers ahead of the local head are never held back
+		{4, 10, 101, 1001, true},
+		{4, 10, 103, 1001, true},
+		{4, 10, 104, 1001, true},
+
+		// Depth boundary with an insufficient advantage
+		{4, 10, 97, 1001, false},
+		{4, 10, 96, 1001, true},
+
+		// Advantage boundary within the sticky depth
+		{4, 10, 99, 1009, false},
+		{4, 10, 99, 1010, true},
+		{4, 10, 99, 1011, true},
+		{4, 10, 100, 1009, false},
+		{4, 10, 98, 1009, false},
+
+		// Lighter headers are never adopted
+		{4, 10, 101, 999, false},
+	}
+	for i, tt := range tests {
+		extern := reader.NewHeader(tt.number, tt.td, byte(i+1))
+		forker := NewForkChoice(reader, nil, WithStickyHead(tt.depth, big.NewInt(tt.advantage)))
+		reorg, err := forker.ReorgNeeded(local, extern)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		if reorg != tt.reorg {
+			t.Errorf("test %d: reorg mismatch: have %v, want %v", i, reorg, tt.reorg)
+		}
+	}
+}
+
+func TestForkChoiceMinReorgTDAdvantage(t *testing.T) {
+	reader := forkchoicetest.NewReader(params.TestChainConfig)
+	local := reader.NewHeader(100, 1000, 0)
+
+	tests := []struct {
+		delta  int64
+		number uint64
+		td     int64
+		flip   bool
+		reorg  bool
+		rule   int
+	}{
+		// Any advantage wins by default
+		{0, 101, 1001, false, true, RuleTotalDifficulty},
+
+		// Threshold boundary at the same height falls through to the tie breaker
+		{10, 100, 1009, false, false, RuleTieBreak},
+		{10, 100, 1009, true, true, RuleTieBreak},
+		{10, 100, 1010, false, true, RuleTotalDifficulty},
+		{10, 100, 1011, false, true, RuleTotalDifficulty},
+
+		// Higher headers are exempt, lower marginal ones are declined
+		{10, 101, 1001, false, true, RuleTotalDifficulty},
+		{10, 101, 1009, false, true, RuleTotalDifficulty},
+		{10, 99, 1009, true, false, RuleMinTDAdvantage},
+		{10, 99, 1010, false, true, RuleTotalDifficulty},
+
+		// Lighter headers are never adopted
+		{10, 99, 999, true, false, RuleTotalDifficulty},
+	}
+	for i, tt := range tests {
+		var (
+			extern = reader.NewHeader(tt.number, tt.td, byte(i+1))
+			flip   = tt.flip
+			forker = NewForkChoice(reader, nil, WithMinReorgTDAdvantage(big.NewInt(tt.delta)), WithCoinFlip(func() bool { return flip }))
+		)
+		res, err := forker.Evaluate(local, extern)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		if res.Reorg != tt.reorg || res.Rule != tt.rule {
+			t.Errorf("test %d: outcome mismatch: have %v/%d, want %v/%d", i, res.Reorg, res.Rule, tt.reorg, tt.rule)
+		}
+	}
+	// A chain growing by less than the threshold per block keeps advancing
+	forker := NewForkChoice(reader, nil, WithMinReorgTDAdvantage(big.NewInt(10)))
+	head := local
+	for i := 0; i < 5; i++ {
+		child := reader.NewChild(head, 1000+2*int64(i+1), 100)
+		if reorg, err := forker.ReorgNeeded(head, child); err != nil || !reorg {
+			t.Fatalf("extension %d: have %v/%v, want true/nil", i, reorg, err)
+		}
+		head = child
+	}
+}
+
+func TestForkChoiceTdGapMetric(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func(hist metrics.Histogram) {
+		metrics.Enabled = enabled
+		forkChoiceTdGapHist = hist
+	}(forkChoiceTdGapHist)
+	forkChoiceTdGapHist = metrics.NewHistogram(metrics.NewUniformSample(100))
+
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 30, 0)
+		lower  = reader.NewHeader(1, 20, 1)
+		higher = reader.NewHeader(1, 35, 2)
+		forker = NewForkChoice(reader, nil)
+	)
+	forker.ReorgNeeded(local, lower)
+	forker.ReorgNeeded(local, higher)
+
+	snap := forkChoiceTdGapHist.Snapshot()
+	if snap.Count() != 2 {
+		t.Fatalf("sample count mismatch: have %d, want %d", snap.Count(), 2)
+	}
+	if snap.Min() != 5 || snap.Max() != 10 {
+		t.Fatalf("sample range mismatch: have [%d, %d], want [%d, %d]", snap.Min(), snap.Max(), 5, 10)
+	}
+}
+
+// failingSource is a randSource which always fails.
+type failingSource struct{}
+
+func (failingSource) Seed() (int64, error) { return 0, errors.New("entropy exhausted") }
+
+func TestNewForkChoiceErr(t *testing.T) {
+	reader := forkchoicetest.NewReader(params.TestChainConfig)
+	if f, err := NewForkChoiceErr(reader, nil); err != nil || f == nil {
+		t.Fatalf("healthy source: have %v/%v, want fork chooser", f, err)
+	}
+	if f, err := NewForkChoiceErr(reader, nil, withRandSource(failingSource{})); err == nil || f != nil {
+		t.Fatalf("failing source: have %v/%v, want error", f, err)
+	}
+}
+
+func TestForkChoiceRandSource(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		a      = NewForkChoice(reader, nil, withRandSource(fixedSource(42)))
+		b      = NewForkChoice(reader, nil, withRandSource(fixedSource(42)))
+		want   = mrand.New(mrand.NewSource(42))
+	)
+	for i := 0; i < 64; i++ {
+		x, y, z := a.rand.Int63(), b.rand.Int63(), want.Int63()
+		if x != z || y != z {
+			t.Fatalf("draw %d: sequence mismatch: have %d/%d, want %d", i, x, y, z)
+		}
+	}
+}
+
+func TestNewForkChoiceSeeded(t *testing.T) {
+	flips := func(genesis *types.Header) []bool {
+		var (
+			reader  = forkchoicetest.NewReader(params.TestChainConfig)
+			local   = reader.NewHeader(1, 10, 0)
+			sibling = reader.NewHeader(1, 10, 1)
+			flips   = make([]bool, 64)
+		)
+		reader.SetCanonical(genesis)
+
+		forker := NewForkChoiceSeeded(reader, nil)
+		for i := range flips {
+			flips[i], _ = forker.ReorgNeeded(local, sibling)
+		}
+		return flips
+	}
+	var (
+		genesis = &types.Header{Number: big.NewInt(0)}
+		other   = &types.Header{Number: big.NewInt(0), Extra: []byte{1}}
+	)
+	if a, b := flips(genesis), flips(genesis); !slices.Equal(a, b) {
+		t.Errorf("flip sequences differ for the same genesis:\n%v\n%v", a, b)
+	}
+	if a, b := flips(genesis), flips(other); slices.Equal(a, b) {
+		t.Errorf("flip sequences match for different genesis blocks")
+	}
+}
+
+func TestForkChoiceCoinFlipMetrics(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func(reorgs, keeps metrics.Counter) {
+		metrics.Enabled = enabled
+		forkChoiceFlipReorgCounter, forkChoiceFlipKeepCounter = reorgs, keeps
+	}(forkChoiceFlipReorgCounter, forkChoiceFlipKeepCounter)
+	forkChoiceFlipReorgCounter, forkChoiceFlipKeepCounter = metrics.NewCounter(), metrics.NewCounter()
+
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		local   = reader.NewHeader(1, 10, 0)
+		sibling = reader.NewHeader(1, 10, 1)
+		forker  = NewForkChoice(reader, nil)
+	)
+	// Replay the flips of an identically seeded generator
+	forker.rand = mrand.New(mrand.NewSource(1))
+	var (
+		replay       = mrand.New(mrand.NewSource(1))
+		reorgs, keep int64
+	)
+	for i := 0; i < 1000; i++ {
+		if replay.Float64() < defaultReorgTieProbability {
+			reorgs++
+		} else {
+			keep++
+		}
+		forker.ReorgNeeded(local, sibling)
+	}
+	if have := forkChoiceFlipReorgCounter.Snapshot().Count(); have != reorgs {
+		t.Errorf("reorg flips mismatch: have %d, want %d", have, reorgs)
+	}
+	if have := forkChoiceFlipKeepCounter.Snapshot().Count(); have != keep {
+		t.Errorf("keep flips mismatch: have %d, want %d", have, keep)
+	}
+	// Decisions not reaching the coin flip are not counted
+	forker.ReorgNeeded(local, reader.NewHeader(1, 11, 2))
+	if have := forkChoiceFlipReorgCounter.Snapshot().Count() + forkChoiceFlipKeepCounter.Snapshot().Count(); have != 1000 {
+		t.Errorf("total flips mismatch: have %d, want %d", have, 1000)
+	}
+}
+
+func TestForkChoiceTdGauges(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func(local, extern metrics.Gauge) {
+		metrics.Enabled = enabled
+		forkChoiceLocalTdGauge, forkChoiceExternTdGauge = local, extern
+	}(forkChoiceLocalTdGauge, forkChoiceExternTdGauge)
+	forkChoiceLocalTdGauge, forkChoiceExternTdGauge = metrics.NewGauge(), metrics.NewGauge()
+
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 30, 0)
+		forker = NewForkChoice(reader, nil)
+	)
+	huge := reader.NewHeader(2, 0, 2)
+	reader.TDs[huge.Hash()] = new(big.Int).Lsh(common.Big1, 64)
+
+	tests := []struct {
+		extern       *types.Header
+		local, value int64
+	}{
+		{reader.NewHeader(1, 20, 1), 30, 20},
+		{reader.NewHeader(1, 35, 3), 30, 35},
+		{huge, 30, math.MaxInt64},
+	}
+	for i, tt := range tests {
+		forker.ReorgNeeded(local, tt.extern)
+		if have := forkChoiceLocalTdGauge.Snapshot().Value(); have != tt.local {
+			t.Errorf("test %d: local td mismatch: have %d, want %d", i, have, tt.local)
+		}
+		if have := forkChoiceExternTdGauge.Snapshot().Value(); have != tt.value {
+			t.Errorf("test %d: extern td mismatch: have %d, want %d", i, have, tt.value)
+		}
+	}
+}
+
+func TestForkChoiceShadow(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func(counter metrics.Counter) {
+		metrics.Enabled = enabled
+		forkChoiceShadowDisagreeCounter = counter
+	}(forkChoiceShadowDisagreeCounter)
+	forkChoiceShadowDisagreeCounter = metrics.NewCounter()
+
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		local   = reader.NewHeader(1, 10, 0)
+		sibling = reader.NewHeader(1, 10, 1)
+		heavier = reader.NewHeader(2, 11, 2)
+		always  = NewForkChoice(reader, nil, WithCoinFlip(func() bool { return true }))
+		never   = NewForkChoice(reader, nil, WithCoinFlip(func() bool { return false }))
+		forker  = NewForkChoiceShadow(always, never)
+	)
+	// Agreeing decisions are not counted
+	if reorg, err := forker.ReorgNeeded(local, heavier); err != nil || !reorg {
+		t.Fatalf("heavier extern: have %v/%v, want true/nil", reorg, err)
+	}
+	if have := forkChoiceShadowDisagreeCounter.Snapshot().Count(); have != 0 {
+		t.Fatalf("disagreements mismatch: have %d, want %d", have, 0)
+	}
+	// Disagreeing ties are counted, but the primary decides
+	for i := 0; i < 3; i++ {
+		if reorg, err := forker.ReorgNeeded(local, sibling); err != nil || !reorg {
+			t.Fatalf("tie %d: have %v/%v, want true/nil", i, reorg, err)
+		}
+	}
+	if have := forkChoiceShadowDisagreeCounter.Snapshot().Count(); have != 3 {
+		t.Fatalf("disagreements mismatch: have %d, want %d", have, 3)
+	}
+	// Primary errors are returned, shadow ones ignored
+	unknown := reader.NewHeader(2, -1, 3)
+	if _, err := forker.ReorgNeeded(local, unknown); !errors.Is(err, ErrMissingTD) {
+		t.Fatalf("primary error mismatch: have %v, want %v", err, ErrMissingTD)
+	}
+	lenient := NewForkChoice(reader, nil, WithTrustExternOnMissingTD(func(*types.Header) bool { return true }))
+	if reorg, err := NewForkChoiceShadow(lenient, always).ReorgNeeded(local, unknown); err != nil || !reorg {
+		t.Fatalf("shadow error: have %v/%v, want true/nil", reorg, err)
+	}
+}
+
+// Tests that only the primary fork chooser of a shadow pair updates the fork
+// choice metrics, and that the shadow is skipped when the primary short-circuits.
+func TestForkChoiceShadowQuiet(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func(timer metrics.Timer, gap metrics.Histogram, reorgs, keeps metrics.Counter) {
+		metrics.Enabled = enabled
+		forkChoiceTdTimer, forkChoiceTdGapHist = timer, gap
+		forkChoiceFlipReorgCounter, forkChoiceFlipKeepCounter = reorgs, keeps
+	}(forkChoiceTdTimer, forkChoiceTdGapHist, forkChoiceFlipReorgCounter, forkChoiceFlipKeepCounter)
+	forkChoiceTdTimer = metrics.NewTimer()
+	forkChoiceTdGapHist = metrics.NewHistogram(metrics.NewUniformSample(100))
+	forkChoiceFlipReorgCounter, forkChoiceFlipKeepCounter = metrics.NewCounter(), metrics.NewCounter()
+
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		local   = reader.NewHeader(1, 10, 0)
+		sibling = reader.NewHeader(1, 10, 1)
+		mirror  = *reader // Shares the chain, but counts the shadow's reads
+		forker  = NewForkChoiceShadow(NewForkChoice(reader, nil), NewForkChoice(&mirror, nil))
+	)
+	for i := 0; i < 5; i++ {
+		if _, err := forker.ReorgNeeded(local, sibling); err != nil {
+			t.Fatalf("tie %d: unexpected error: %v", i, err)
+		}
+	}
+	if have := forkChoiceTdTimer.Snapshot().Count(); have != 5 {
+		t.Errorf("timer samples mismatch: have %d, want %d", have, 5)
+	}
+	if have := forkChoiceTdGapHist.Snapshot().Count(); have != 5 {
+		t.Errorf("gap samples mismatch: have %d, want %d", have, 5)
+	}
+	if have := forkChoiceFlipReorgCounter.Snapshot().Count() + forkChoiceFlipKeepCounter.Snapshot().Count(); have != 5 {
+		t.Errorf("coin flips mismatch: have %d, want %d", have, 5)
+	}
+	// The shadow is not consulted on the local head itself
+	reads := mirror.TdReads
+	if reorg, err := forker.ReorgNeeded(local, local); err != nil || reorg {
+		t.Errorf("same header: have %v/%v, want false/nil", reorg, err)
+	}
+	if mirror.TdReads != reads {
+		t.Errorf("shadow consulted on the local head: %d td reads", mirror.TdReads-reads)
+	}
+}
+
+func TestForkChoiceTimerMetric(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func(timer metrics.Timer) {
+		metrics.Enabled = enabled
+		forkChoiceTdTimer = timer
+	}(forkChoiceTdTimer)
+	forkChoiceTdTimer = metrics.NewTimer()
+
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 10, 0)
+		forker = NewForkChoice(reader, nil)
+	)
+	for i := 1; i <= 3; i++ {
+		forker.ReorgNeeded(local, reader.NewHeader(1, int64(10+i), byte(i)))
+		if count := forkChoiceTdTimer.Snapshot().Count(); count != int64(i) {
+			t.Fatalf("evaluation %d: timer count mismatch: have %d, want %d", i, count, i)
+		}
+	}
+}
+
+func TestTdGapClamped(t *testing.T) {
+	huge := new(big.Int).Lsh(big.NewInt(1), 100)
+	tests := []struct {
+		local, extern *big.Int
+		want          int64
+	}{
+		{big.NewInt(10), big.NewInt(10), 0},
+		{big.NewInt(10), big.NewInt(15), 5},
+		{big.NewInt(15), big.NewInt(10), 5},
+		{big.NewInt(0), huge, math.MaxInt64},
+		{huge, big.NewInt(0), math.MaxInt64},
+	}
+	for i, tt := range tests {
+		if have := tdGap(tt.local, tt.extern); have != tt.want {
+			t.Errorf("test %d: gap mismatch: have %d, want %d", i, have, tt.want)
+		}
+	}
+}
+
+// panickingChainReader is a ChainReader failing hard on any database access.
+type panickingChainReader struct {
+	*forkchoicetest.Reader
+}
+
+func (r *panickingChainReader) GetTd(hash common.Hash, number uint64) *big.Int {
+	panic("database failure")
+}
+
+func TestForkChoicePanicRecovery(t *testing.T) {
+	var (
+		reader = &panickingChainReader{forkchoicetest.NewReader(params.TestChainConfig)}
+		local  = reader.NewHeader(1, 10, 0)
+		extern = reader.NewHeader(1, 20, 1)
+		forker = NewForkChoice(reader, nil)
+	)
+	if reorg, err := forker.ReorgNeeded(local, extern); err == nil || reorg {
+		t.Errorf("panicking reader: have %v/%v, want false/error", reorg, err)
+	}
+	if index, err := forker.ReorgNeededChain(local, []*types.Header{extern}); err == nil || index != -1 {
+		t.Errorf("panicking reader in chain: have %v/%v, want -1/error", index, err)
+	}
+	// Malformed headers must not crash the evaluation either
+	var (
+		healthy   = forkchoicetest.NewReader(params.TestChainConfig)
+		current   = healthy.NewHeader(1, 10, 0)
+		malformed = &types.Header{Difficulty: big.NewInt(1)}
+	)
+	forker = NewForkChoice(healthy, nil)
+	if reorg, err := forker.ReorgNeeded(current, malformed); err == nil || reorg {
+		t.Errorf("malformed header: have %v/%v, want false/error", reorg, err)
+	}
+	if index, err := forker.ReorgNeededChain(current, []*types.Header{malformed}); err == nil || index != -1 {
+		t.Errorf("malformed header in chain: have %v/%v, want -1/error", index, err)
+	}
+}
+
+func TestForkChoiceTdCache(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 10, 0)
+		extern = reader.NewHeader(1, 20, 1)
+		forker = NewForkChoice(reader, nil)
+	)
+	for i := 0; i < 3; i++ {
+		if reorg, err := forker.ReorgNeeded(local, extern); err != nil || !reorg {
+			t.Fatalf("evaluation %d: have %v/%v, want true/nil", i, reorg, err)
+		}
+	}
+	if reader.TdReads != 2 {
+		t.Fatalf("database reads mismatch: have %d, want %d", reader.TdReads, 2)
+	}
+	// Rewrite the extern td, expect the cached version until reset
+	reader.TDs[extern.Hash()] = big.NewInt(5)
+	if reorg, _ := forker.ReorgNeeded(local, extern); !reorg {
+		t.Fatalf("cached td not used")
+	}
+	forker.ResetCache()
+	if reorg, _ := forker.ReorgNeeded(local, extern); reorg {
+		t.Fatalf("stale td served after reset")
+	}
+	if reader.TdReads != 4 {
+		t.Fatalf("database reads mismatch: have %d, want %d", reader.TdReads, 4)
+	}
+}
+
+// Tests that modifying the total difficulties returned by Evaluate doesn't
+// corrupt the memoized ones.
+func TestForkChoiceEvaluateDetached(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 10, 0)
+		extern = reader.NewHeader(1, 20, 1)
+		forker = NewForkChoice(reader, nil)
+	)
+	res, err := forker.Evaluate(local, extern)
+	if err != nil || !res.Reorg {
+		t.Fatalf("heavier extern: have %v/%v, want true/nil", res.Reorg, err)
+	}
+	res.LocalTD.SetInt64(30)
+	res.ExternTD.SetInt64(5)
+
+	if res, err = forker.Evaluate(local, extern); err != nil || !res.Reorg {
+		t.Fatalf("re-evaluation: have %v/%v, want true/nil", res.Reorg, err)
+	}
+	if res.LocalTD.Int64() != 10 || res.ExternTD.Int64() != 20 {
+		t.Errorf("td mismatch: have %v/%v, want 10/20", res.LocalTD, res.ExternTD)
+	}
+	if td := reader.TDs[extern.Hash()]; td.Int64() != 20 {
+		t.Errorf("reader td modified: have %v, want 20", td)
+	}
+}
+
+func TestForkChoiceTdCacheDisabled(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(1, 10, 0)
+		extern = reader.NewHeader(1, 20, 1)
+		forker = NewForkChoice(reader, nil, WithTdCacheSize(0))
+	)
+	for i := 0; i < 3; i++ {
+		forker.ReorgNeeded(local, extern)
+	}
+	if reader.TdReads != 6 {
+		t.Fatalf("database reads mismatch: have %d, want %d", reader.TdReads, 6)
+	}
+}
+
+func TestForkChoiceTdCacheBounded(t *testing.T) {
+	var (
+		reader = forkchoicetest.NewReader(params.TestChainConfig)
+		local  = reader.NewHeader(0, 1, 0)
+		forker = NewForkChoice(reader, nil, WithTdCacheSize(4))
+	)
+	for i := 1; i <= 16; i++ {
+		forker.ReorgNeeded(local, reader.NewHeader(uint64(i), int64(i+1), 0))
+	}
+	if n := forker.tdCache.Len(); n != 4 {
+		t.Fatalf("cache size mismatch: have %d, want %d", n, 4)
+	}
+}
+
+func BenchmarkForkChoice(b *testing.B) {
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		local   = reader.NewHeader(2, 10, 0)
+		heavier = reader.NewHeader(2, 20, 1)
+		lower   = reader.NewHeader(1, 10, 2)
+		sibling = reader.NewHeader(2, 10, 3)
+	)
+	b.Run("unequal-td", func(b *testing.B) { benchmarkForkChoice(b, reader, local, heavier) })
+	b.Run("equal-td-number", func(b *testing.B) { benchmarkForkChoice(b, reader, local, lower) })
+	b.Run("equal-td-coinflip", func(b *testing.B) { benchmarkForkChoice(b, reader, local, sibling) })
+	b.Run("equal-td-lowest-hash", func(b *testing.B) {
+		benchmarkForkChoice(b, reader, local, sibling, WithDeterministicTies())
+	})
+}
+
+// benchmarkForkChoice repeatedly evaluates the same pair of headers.
+func benchmarkForkChoice(b *testing.B, reader ChainReader, local, extern *types.Header, opts ...ForkChoiceOption) {
+	forker := NewForkChoice(reader, nil, opts...)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		forker.ReorgNeeded(local, extern)
+	}
+}
+
+func BenchmarkForkChoiceTdCache(b *testing.B) {
+	b.Run("cached", func(b *testing.B) { benchmarkForkChoiceTdCache(b, defaultTdCacheSize) })
+	b.Run("uncached", func(b *testing.B) { benchmarkForkChoiceTdCache(b, 0) })
+}
+
+// dbChainReader is a ChainReader serving total difficulties from a database.
+type dbChainReader struct {
+	config *params.ChainConfig
+	db     ethdb.Database
+}
+
+func (r *dbChainReader) Config() *params.ChainConfig { return r.config }
+
+func (r *dbChainReader) GetTd(hash common.Hash, number uint64) *big.Int {
+	return rawdb.ReadTd(r.db, hash, number)
+}
+
+func (r *dbChainReader) GetCanonicalHash(number uint64) common.Hash {
+	return rawdb.ReadCanonicalHash(r.db, number)
+}
+
+func (r *dbChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	number := rawdb.ReadHeaderNumber(r.db, hash)
+	if number == nil {
+		return nil
+	}
+	return rawdb.ReadHeader(r.db, hash, *number)
+}
+
+func (r *dbChainReader) CurrentHeader() *types.Header {
+	return r.GetHeaderByHash(rawdb.ReadHeadHeaderHash(r.db))
+}
+
+func (r *dbChainReader) PruningHorizon() uint64 { return 0 }
+
+// benchmarkForkChoiceTdCache evaluates a synthetic 10k header side chain
+// against a fixed local head, as done during sync.
+func benchmarkForkChoiceTdCache(b *testing.B, size int) {
+	var (
+		reader  = &dbChainReader{config: params.TestChainConfig, db: rawdb.NewMemoryDatabase()}
+		headers = make([]*types.Header, 10001)
+	)
+	for i := range headers {
+		headers[i] = &types.Header{Number: big.NewInt(int64(i)), Difficulty: big.NewInt(1)}
+		rawdb.WriteTd(reader.db, headers[i].Hash(), uint64(i), big.NewInt(int64(i+1)))
+	}
+	var (
+		local   = headers[len(headers)-1]
+		externs = headers[1 : len(headers)-1]
+		forker  = NewForkChoice(reader, nil, WithTdCacheSize(size))
+	)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		forker.ReorgNeeded(local, externs[i%len(externs)])
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package forkchoicetest provides an in-memory core.ChainReader for testing
+// the fork chooser.
+package forkchoicetest
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Reader is a chain reader serving total difficulties, canonical hashes and
+// headers from memory. All fields may be modified directly to shape the chain
+// seen by the fork chooser.
+type Reader struct {
+	ChainConfig *params.ChainConfig
+	TDs         map[common.Hash]*big.Int
+	Canon       map[uint64]common.Hash
+	Headers     map[common.Hash]*types.Header
+	Head        *types.Header // Current head of the canonical chain
+	Horizon     uint64        // First block with a retained total difficulty
+
+	TdReads     int // Number of GetTd invocations
+	ConfigReads int // Number of Config invocations
+	HeaderReads int // Number of GetHeaderByHash invocations
+}
+
+// NewReader creates an empty chain reader with the given chain configuration.
+func NewReader(config *params.ChainConfig) *Reader {
+	return &Reader{
+		ChainConfig: config,
+		TDs:         make(map[common.Hash]*big.Int),
+		Canon:       make(map[uint64]common.Hash),
+		Headers:     make(map[common.Hash]*types.Header),
+	}
+}
+
+// Config retrieves the chain configuration.
+func (r *Reader) Config() *params.ChainConfig {
+	r.ConfigReads++
+	return r.ChainConfig
+}
+
+// GetTd returns the total difficulty of a block, or nil if unknown.
+func (r *Reader) GetTd(hash common.Hash, number uint64) *big.Int {
+	r.TdReads++
+	return r.TDs[hash]
+}
+
+// GetCanonicalHash returns the hash of the canonical block at a height.
+func (r *Reader) GetCanonicalHash(number uint64) common.Hash {
+	return r.Canon[number]
+}
+
+// CurrentHeader returns the current head of the canonical chain.
+func (r *Reader) CurrentHeader() *types.Header {
+	return r.Head
+}
+
+// GetHeaderByHash retrieves a header by its hash, or nil if unknown.
+func (r *Reader) GetHeaderByHash(hash common.Hash) *types.Header {
+	r.HeaderReads++
+	return r.Headers[hash]
+}
+
+// PruningHorizon returns the first block with a retained total difficulty.
+func (r *Reader) PruningHorizon() uint64 {
+	return r.Horizon
+}
+
+// NewHeader creates a header at the given height and records it in the reader
+// along with its total difficulty. A negative td leaves the total difficulty
+// unknown. The extra field is used to produce distinct hashes for otherwise
+// identical headers.
+func (r *Reader) NewHeader(number uint64, td int64, extra byte) *types.Header {
+	return r.add(&types.Header{
+		Number:     new(big.Int).SetUint64(number),
+		Difficulty: big.NewInt(1),
+		Extra:      []byte{extra},
+	}, td)
+}
+
+// NewChild creates a child of the given header and records it in the reader
+// along with its total difficulty. A negative td leaves the total difficulty
+// unknown.
+func (r *Reader) NewChild(parent *types.Header, td int64, extra byte) *types.Header {
+	return r.add(&types.Header{
+		ParentHash: parent.Hash(),
+		Number:     new(big.Int).Add(parent.Number, common.Big1),
+		Difficulty: big.NewInt(1),
+		Extra:      []byte{extra},
+	}, td)
+}
+
+// NewChain creates n consecutive descendants of the given header, each adding
+// a difficulty of one to the total difficulty of its parent. The parent's total
+// difficulty must be known.
+func (r *Reader) NewChain(parent *types.Header, n int, extra byte) []*types.Header {
+	var (
+		headers = make([]*types.Header, 0, n)
+		td      = r.TDs[parent.Hash()].Int64()
+	)
+	for i := 0; i < n; i++ {
+		td++
+		parent = r.NewChild(parent, td, extra)
+		headers = append(headers, parent)
+	}
+	return headers
+}
+
+// SetCanonical marks the given headers as canonical at their heights, the last
+// one becoming the current head.
+func (r *Reader) SetCanonical(headers ...*types.Header) {
+	for _, header := range headers {
+		r.Canon[header.Number.Uint64()] = header.Hash()
+		r.Head = header
+	}
+}
+
+// add records a header and, if it is non-negative, its total difficulty.
+func (r *Reader) add(header *types.Header, td int64) *types.Header {
+	hash := header.Hash()
+	if td >= 0 {
+		r.TDs[hash] = big.NewInt(td)
+	}
+	r.Headers[hash] = header
+	return header
+}
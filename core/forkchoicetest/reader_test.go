@@ -0,0 +1,82 @@
+// Copyright 2024 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package forkchoicetest_test
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/forkchoicetest"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var _ core.ChainReader = (*forkchoicetest.Reader)(nil)
+
+func TestReader(t *testing.T) {
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		genesis = reader.NewHeader(0, 1, 0)
+		unknown = reader.NewHeader(1, -1, 1)
+		chain   = reader.NewChain(genesis, 3, 2)
+	)
+	reader.SetCanonical(genesis)
+	reader.SetCanonical(chain...)
+
+	if reader.CurrentHeader() != chain[2] {
+		t.Errorf("head mismatch: have %v, want %v", reader.CurrentHeader(), chain[2])
+	}
+	if reader.Config() != params.TestChainConfig {
+		t.Errorf("config mismatch")
+	}
+	if td := reader.GetTd(unknown.Hash(), 1); td != nil {
+		t.Errorf("unknown header has td %v", td)
+	}
+	for i, header := range chain {
+		number := header.Number.Uint64()
+		if number != uint64(i+1) {
+			t.Errorf("header %d: number mismatch: have %d, want %d", i, number, i+1)
+		}
+		if parent := reader.GetHeaderByHash(header.ParentHash); parent == nil || parent.Number.Uint64() != number-1 {
+			t.Errorf("header %d: parent not linked", i)
+		}
+		if td := reader.GetTd(header.Hash(), number); td == nil || td.Uint64() != number+1 {
+			t.Errorf("header %d: td mismatch: have %v, want %d", i, td, number+1)
+		}
+		if hash := reader.GetCanonicalHash(number); hash != header.Hash() {
+			t.Errorf("header %d: canonical hash mismatch: have %x, want %x", i, hash, header.Hash())
+		}
+	}
+	if reader.TdReads != 4 || reader.ConfigReads != 1 || reader.HeaderReads != 3 {
+		t.Errorf("access counters mismatch: have %d/%d/%d, want 4/1/3", reader.TdReads, reader.ConfigReads, reader.HeaderReads)
+	}
+}
+
+func TestReaderForkChoice(t *testing.T) {
+	var (
+		reader  = forkchoicetest.NewReader(params.TestChainConfig)
+		genesis = reader.NewHeader(0, 1, 0)
+		local   = reader.NewChain(genesis, 2, 1)
+		extern  = reader.NewChain(genesis, 3, 2)
+		forker  = core.NewForkChoice(reader, nil)
+	)
+	if reorg, err := forker.ReorgNeeded(local[1], extern[2]); err != nil || !reorg {
+		t.Errorf("longer fork: have %v/%v, want true/nil", reorg, err)
+	}
+	if reorg, err := forker.ReorgNeeded(extern[2], local[1]); err != nil || reorg {
+		t.Errorf("shorter fork: have %v/%v, want false/nil", reorg, err)
+	}
+}
@@ -51,7 +51,7 @@ func verifyUnbrokenCanonchain(hc *HeaderChain) error {
 	return nil
 }
 
-func testInsert(t *testing.T, hc *HeaderChain, chain []*types.Header, wantStatus WriteStatus, wantErr error, forker *ForkChoice) {
+func testInsert(t *testing.T, hc *HeaderChain, chain []*types.Header, wantStatus WriteStatus, wantErr error, forker ForkChoicer) {
 	t.Helper()
 
 	status, err := hc.InsertHeaderChain(chain, time.Now(), forker)
@@ -114,3 +114,45 @@ func TestHeaderInsertion(t *testing.T) {
 	// And B becomes even longer
 	testInsert(t, hc, chainB[107:128], CanonStatTy, nil, forker)
 }
+
+// testForkChoicer is a ForkChoicer returning a preset decision.
+type testForkChoicer struct {
+	reorg bool
+	calls int
+}
+
+func (f *testForkChoicer) ReorgNeeded(current *types.Header, extern *types.Header) (bool, error) {
+	f.calls++
+	return f.reorg, nil
+}
+
+// Tests that the header insertion defers the head selection to the injected
+// fork choicer.
+func TestHeaderInsertionForkChoicer(t *testing.T) {
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		gspec = &Genesis{BaseFee: big.NewInt(params.InitialBaseFee), Config: params.AllEthashProtocolChanges}
+	)
+	gspec.Commit(db, trie.NewDatabase(db, nil))
+	hc, err := NewHeaderChain(db, gspec.Config, ethash.NewFaker(), func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, chain := makeHeaderChainWithGenesis(gspec, 8, ethash.NewFaker(), 10)
+
+	// A rejecting forker keeps the new headers on a side chain
+	forker := &testForkChoicer{reorg: false}
+	testInsert(t, hc, chain[:4], SideStatTy, nil, forker)
+	if forker.calls != 1 {
+		t.Fatalf("fork choicer calls mismatch: have %d, want %d", forker.calls, 1)
+	}
+	if head := hc.CurrentHeader().Number.Uint64(); head != 0 {
+		t.Fatalf("head moved: have #%d, want #%d", head, 0)
+	}
+	// An accepting forker moves the head onto the new headers
+	forker = &testForkChoicer{reorg: true}
+	testInsert(t, hc, chain[4:], CanonStatTy, nil, forker)
+	if head := hc.CurrentHeader().Number.Uint64(); head != 8 {
+		t.Fatalf("head mismatch: have #%d, want #%d", head, 8)
+	}
+}